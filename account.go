@@ -0,0 +1,362 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/redis.v2"
+)
+
+const (
+	//AccountDeletionGrace is how long a deleted account's document is kept before it
+	//is gone for good
+	AccountDeletionGrace = time.Hour * 24 * 30
+
+	//accountPurgeEvery is how often we look for accounts past their grace period
+	accountPurgeEvery = time.Hour
+
+	deletedUsername = "deleted"
+)
+
+// the keys under users:<username>: that go with the account. tokens-after
+// is not one of them, it has to outlive the account to turn away the tokens
+// issued before it was deleted
+var accountRedisKeys = []string{
+	"followers", "following", "blocked", "blocked-by", "muted", "timeline",
+	"credits", "refresh", "totp-pending", "totp-last",
+}
+
+//AccountExport is everything we hold about a user, handed to them on request
+type AccountExport struct {
+	ExportedAt   time.Time     `json:"exported_at"`
+	User         SelfUser      `json:"user"`
+	Identities   []lookUp      `json:"identities"`
+	Sessions     []Session     `json:"sessions"`
+	APIKeys      []APIKey      `json:"api_keys"`
+	Skills       []Skill       `json:"skills"`
+	Reviews      []Review      `json:"reviews"`
+	Transactions []Transaction `json:"transactions"`
+	Feeds        []Feed        `json:"feeds"`
+	Followers    []string      `json:"followers"`
+	Following    []string      `json:"following"`
+	Blocked      []string      `json:"blocked"`
+	Muted        []string      `json:"muted"`
+}
+
+//Utility methods
+
+// returns the posts on the user's timeline they wrote themselves, as
+// {id, post} pairs
+var authoredPostsRedisScript = redis.NewScript(`
+	local ids = redis.call("lrange", "users:"..KEYS[1]..":timeline", 0, -1)
+	local result = {}
+	for i=1,#ids do
+		local post = redis.call("get", "posts:"..ids[i])
+		if post then
+			local ok, feed = pcall(cjson.decode, post)
+			if ok and feed["subjectid"] == KEYS[1] then
+				table.insert(result, {ids[i], post})
+			end
+		end
+	end
+	return result
+`)
+
+//authoredPosts returns the feed items username wrote, keyed by post id
+func (c *appContext) authoredPosts(username string) (map[string]Feed, error) {
+	resp, err := authoredPostsRedisScript.Run(c.redis, []string{username}, []string{}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	posts := map[string]Feed{}
+	for _, rr := range resp.([]interface{}) {
+		fields := rr.([]interface{})
+		feed := Feed{}
+		err = json.Unmarshal([]byte(fields[1].(string)), &feed)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		posts[fields[0].(string)] = feed
+	}
+	return posts, nil
+}
+
+//exportAccount gathers everything we hold about user
+func (c *appContext) exportAccount(user *User) (*AccountExport, error) {
+	export := &AccountExport{ExportedAt: time.Now(), User: selfUser(user)}
+
+	repo := UserRepo{c.db.C("users")}
+	id, err := repo.userID(bson.M{"username": user.Username})
+	if err != nil {
+		return nil, err
+	}
+	ids := IdentityRepo{c.db.C("identities")}
+	export.Identities, err = ids.All(id)
+	if err != nil {
+		return nil, err
+	}
+
+	export.Sessions, err = c.listSessions(user.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := APIKeyRepo{c.db.C("apikeys")}
+	apiKeys, err := keys.All(user.Username)
+	if err != nil {
+		return nil, err
+	}
+	export.APIKeys = apiKeys.Data
+
+	skills := SkillRepo{c.db.C("skills"), c.search}
+	owned, err := skills.All(user.Username)
+	if err != nil {
+		return nil, err
+	}
+	export.Skills = owned.Data
+
+	export.Reviews = []Review{}
+	err = c.db.C("reviews").Find(bson.M{"username": user.Username}).All(&export.Reviews)
+	if err != nil {
+		return nil, err
+	}
+
+	export.Transactions = []Transaction{}
+	err = c.db.C("transactions").Find(bson.M{"$or": []bson.M{
+		{"subjectid": user.Username},
+		{"objectid": user.Username},
+	}}).All(&export.Transactions)
+	if err != nil {
+		return nil, err
+	}
+
+	posts, err := c.authoredPosts(user.Username)
+	if err != nil {
+		return nil, err
+	}
+	export.Feeds = []Feed{}
+	for _, feed := range posts {
+		export.Feeds = append(export.Feeds, feed)
+	}
+
+	export.Followers, err = c.redis.SMembers("users:" + user.Username + ":followers").Result()
+	if err != nil {
+		return nil, err
+	}
+	export.Following, err = c.redis.SMembers("users:" + user.Username + ":following").Result()
+	if err != nil {
+		return nil, err
+	}
+	export.Blocked, err = c.redis.SMembers("users:" + user.Username + ":blocked").Result()
+	if err != nil {
+		return nil, err
+	}
+	export.Muted, err = c.redis.SMembers("users:" + user.Username + ":muted").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	return export, nil
+}
+
+// takes the user out of everyone else's follow and block sets before
+// their own keys go
+var unfollowAllRedisScript = redis.NewScript(`
+	local followers = redis.call("smembers", "users:"..KEYS[1]..":followers")
+	for i=1,#followers do
+		redis.call("srem", "users:"..followers[i]..":following", KEYS[1])
+	end
+	local following = redis.call("smembers", "users:"..KEYS[1]..":following")
+	for i=1,#following do
+		redis.call("srem", "users:"..following[i]..":followers", KEYS[1])
+	end
+	local blocked = redis.call("smembers", "users:"..KEYS[1]..":blocked")
+	for i=1,#blocked do
+		redis.call("srem", "users:"..blocked[i]..":blocked-by", KEYS[1])
+	end
+	local blockedBy = redis.call("smembers", "users:"..KEYS[1]..":blocked-by")
+	for i=1,#blockedBy do
+		redis.call("srem", "users:"..blockedBy[i]..":blocked", KEYS[1])
+	end
+	return 1
+`)
+
+//deleteAccount takes everything of user's offline straight away. Their reviews stay
+//up without their name, their skills and everything in redis go, every token they hold
+//is revoked and the user document itself is purged once the grace period is over
+func (c *appContext) deleteAccount(user *User) error {
+	now := time.Now()
+	err := c.db.C("users").Update(bson.M{
+		"username": user.Username,
+	}, bson.M{
+		"$set": bson.M{"deletedat": now, "purgeat": now.Add(AccountDeletionGrace)},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = c.revokeAllTokens(user.Username)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.db.C("apikeys").RemoveAll(bson.M{"owner": user.Username})
+	if err != nil {
+		return err
+	}
+
+	skills := SkillRepo{c.db.C("skills"), c.search}
+	owned, err := skills.DeleteOwner(user.Username)
+	if err != nil {
+		return err
+	}
+	for _, s := range owned {
+		c.deleteImages(s.Images...)
+	}
+	if user.Avatar != nil {
+		c.deleteImages(*user.Avatar)
+	}
+
+	_, err = c.db.C("reviews").UpdateAll(bson.M{
+		"username": user.Username,
+	}, bson.M{
+		"$set": bson.M{"username": deletedUsername},
+		// reviews from before the author was a PublicUser kept the whole user,
+		// password hash and all, under "omitempty"
+		"$unset": bson.M{"user": "", "omitempty": ""},
+	})
+	if err != nil {
+		return err
+	}
+
+	// posts stay on other people's timelines, so they are rewritten
+	// rather than removed
+	posts, err := c.authoredPosts(user.Username)
+	if err != nil {
+		return err
+	}
+	for id, feed := range posts {
+		feed.SubjectID = deletedUsername
+		feed.Review.Username = deletedUsername
+		feed.Review.User = nil
+		b, err := json.Marshal(feed)
+		if err != nil {
+			return err
+		}
+		err = c.redis.Set("posts:"+id, string(b)).Err()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = unfollowAllRedisScript.Run(c.redis, []string{user.Username}, []string{}).Err()
+	if err != nil {
+		return err
+	}
+
+	keys := []string{}
+	for _, suffix := range accountRedisKeys {
+		keys = append(keys, "users:"+user.Username+":"+suffix)
+	}
+	return c.redis.Del(keys...).Err()
+}
+
+//purgeDeletedAccounts removes the documents of deleted accounts whose grace period is over.
+//Their usernames stay taken until then, and are free for anyone after
+func (c *appContext) purgeDeletedAccounts() error {
+	users := []struct {
+		ID       bson.ObjectId `bson:"_id"`
+		Username string        `bson:"username"`
+	}{}
+	err := c.db.C("users").Find(bson.M{
+		"purgeat": bson.M{"$lte": time.Now()},
+	}).Select(bson.M{"_id": 1, "username": 1}).All(&users)
+	if err != nil {
+		return err
+	}
+
+	for _, u := range users {
+		_, err = c.db.C("identities").RemoveAll(bson.M{"userid": u.ID.Hex()})
+		if err != nil {
+			return err
+		}
+		err = c.db.C("users").RemoveId(u.ID)
+		if err != nil && err != mgo.ErrNotFound {
+			return err
+		}
+		if u.Username != "" {
+			err = c.redis.SRem("users", u.Username).Err()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if len(users) > 0 {
+		log.Printf("purged %d deleted accounts\n", len(users))
+	}
+	return nil
+}
+
+//purgeDeletedAccountsEvery runs purgeDeletedAccounts in the background every d
+func (c *appContext) purgeDeletedAccountsEvery(d time.Duration) {
+	go func() {
+		for range time.Tick(d) {
+			err := c.purgeDeletedAccounts()
+			if err != nil {
+				log.Println(err)
+			}
+		}
+	}()
+}
+
+//Handlers
+
+func (c *appContext) exportAccountHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := c.currentUser(r)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrUnauthorized)
+		return
+	}
+
+	export, err := c.exportAccount(user)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="oddjobz-`+user.Username+`.json"`)
+	json.NewEncoder(w).Encode(export)
+}
+
+func (c *appContext) deleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := c.currentUser(r)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrUnauthorized)
+		return
+	}
+
+	err = c.deleteAccount(user)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:   c.token,
+		Value:  "",
+		Path:   "/",
+		MaxAge: -1,
+	})
+	w.WriteHeader(http.StatusAccepted)
+}
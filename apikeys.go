@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// API keys let other services call us without a person signing in. A key is
+// sent in the X-API-KEY header, carries a subset of its owner's permissions
+// and is only ever shown once, we keep the hash.
+const (
+	//APIKeyDefaultTTL is how long a key lives when no expiry is asked for
+	APIKeyDefaultTTL = time.Hour * 24 * 90
+
+	//APIKeyMaxTTL is the longest a key can be made to live
+	APIKeyMaxTTL = time.Hour * 24 * 365
+
+	//apiKeyTouchEvery stops every request through a busy key from writing to mongo
+	apiKeyTouchEvery = time.Minute
+
+	apiKeyHeader = "X-API-KEY"
+	apiKeyPrefix = "ojk_"
+)
+
+var errAPIKeyInvalid = errors.New("api key invalid or expired")
+
+//APIKey is a named, scoped credential belonging to a user
+type APIKey struct {
+	ID       bson.ObjectId `json:"id" bson:"_id"`
+	Name     string        `json:"name"`
+	Prefix   string        `json:"prefix"`
+	Hash     string        `json:"-"`
+	Owner    string        `json:"owner"`
+	Scopes   []string      `json:"scopes"`
+	Created  time.Time     `json:"created"`
+	Expires  time.Time     `json:"expires"`
+	LastUsed time.Time     `json:"last_used,omitempty" bson:"lastused,omitempty"`
+}
+
+//APIKeysCollection holds a slice of api keys under the key "data"
+type APIKeysCollection struct {
+	Data []APIKey `json:"data"`
+}
+
+//APIKeyRequest is the body for minting a key, ExpiresIn is in days
+type APIKeyRequest struct {
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	ExpiresIn int      `json:"expires_in,omitempty"`
+}
+
+//NewAPIKey is sent back when a key is minted, the only time the key itself is seen
+type NewAPIKey struct {
+	Data APIKey `json:"data"`
+	Key  string `json:"key"`
+}
+
+//APIKeyRepo wraps the apikeys collection
+type APIKeyRepo struct {
+	coll *mgo.Collection
+}
+
+//Utility methods
+
+//EnsureIndexes makes keys quick to find by hash and by owner
+func (r *APIKeyRepo) EnsureIndexes() error {
+	err := r.coll.EnsureIndex(mgo.Index{
+		Key:    []string{"hash"},
+		Unique: true,
+	})
+	if err != nil {
+		return err
+	}
+	return r.coll.EnsureIndexKey("owner")
+}
+
+//All returns the keys owned by username
+func (r *APIKeyRepo) All(username string) (APIKeysCollection, error) {
+	result := APIKeysCollection{[]APIKey{}}
+	err := r.coll.Find(bson.M{"owner": username}).Sort("-created").All(&result.Data)
+	return result, err
+}
+
+//Revoke deletes the key id owned by username
+func (r *APIKeyRepo) Revoke(username, id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return mgo.ErrNotFound
+	}
+	return r.coll.Remove(bson.M{"_id": bson.ObjectIdHex(id), "owner": username})
+}
+
+//validScopes reports whether every scope is a permission role carries
+func validScopes(role string, scopes []string) bool {
+	if len(scopes) == 0 {
+		return false
+	}
+	for _, s := range scopes {
+		if !hasPermission(role, s) {
+			return false
+		}
+	}
+	return true
+}
+
+//apiKeyAllows reports whether the key the request came with, if any, was given perm
+func apiKeyAllows(r *http.Request, perm string) bool {
+	claims := claimsget(r)
+	if _, ok := claims["apikey"]; !ok {
+		return true
+	}
+	scopes, _ := claims["scopes"].([]string)
+	for _, s := range scopes {
+		if s == perm {
+			return true
+		}
+	}
+	return false
+}
+
+//isAPIKeyRequest reports whether the request came with an api key
+func isAPIKeyRequest(r *http.Request) bool {
+	_, ok := context.Get(r, "APIKey").(map[string]interface{})
+	return ok
+}
+
+//scopeAPIKey lets the api key the request came with stand in for its owner from here on,
+//if it was given every one of perms. It reports whether it did
+func scopeAPIKey(r *http.Request, perms ...string) bool {
+	claims, ok := context.Get(r, "APIKey").(map[string]interface{})
+	if !ok {
+		return false
+	}
+	scopes, _ := claims["scopes"].([]string)
+	for _, perm := range perms {
+		if !contains(scopes, perm) {
+			return false
+		}
+	}
+	context.Set(r, "User", claims["User"])
+	context.Set(r, "Claims", claims)
+	return true
+}
+
+//apiKeyUser looks up the key and its owner, and notes that the key was used
+func (c *appContext) apiKeyUser(key string) (*APIKey, *User, error) {
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		return nil, nil, errAPIKeyInvalid
+	}
+
+	apiKey := APIKey{}
+	err := c.db.C("apikeys").Find(bson.M{"hash": hashToken(key)}).One(&apiKey)
+	if err == mgo.ErrNotFound {
+		return nil, nil, errAPIKeyInvalid
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	if now.After(apiKey.Expires) {
+		return nil, nil, errAPIKeyInvalid
+	}
+
+	repo := UserRepo{c.db.C("users")}
+	owner, err := repo.Find(apiKey.Owner)
+	if err == mgo.ErrNotFound {
+		return nil, nil, errAPIKeyInvalid
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if now.Sub(apiKey.LastUsed) > apiKeyTouchEvery {
+		err = c.db.C("apikeys").UpdateId(apiKey.ID, bson.M{"$set": bson.M{"lastused": now}})
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	return &apiKey, &owner.Data, nil
+}
+
+//Middlewares
+
+//apiKeyHandler checks the api key a request came with for frontAuthHandler. Unlike an
+//access token the key doesn't sign the request in by itself, only a route that declares
+//a scope the key has does, with requirePermission, requireRole or requireScope. Every
+//other route sees the request as anonymous
+func (ac *appContext) apiKeyHandler(key string, next http.Handler, w http.ResponseWriter, r *http.Request) {
+	apiKey, owner, err := ac.apiKeyUser(key)
+	if err == errAPIKeyInvalid {
+		WriteError(w, ErrInvalidAPIKey)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	// a role lost since the key was minted takes its scopes with it
+	scopes := []string{}
+	for _, s := range apiKey.Scopes {
+		if hasPermission(owner.Permission, s) {
+			scopes = append(scopes, s)
+		}
+	}
+
+	user := map[string]interface{}{
+		"username":   owner.Username,
+		"email":      owner.Email,
+		"provider":   owner.Provider,
+		"permission": owner.Permission,
+	}
+	context.Set(r, "APIKey", map[string]interface{}{
+		"User":        user,
+		"AccessToken": owner.Permission,
+		"apikey":      apiKey.ID.Hex(),
+		"scopes":      scopes,
+	})
+	next.ServeHTTP(w, r)
+}
+
+//humanHandler keeps api keys away from endpoints that manage the account itself, like
+//minting more keys, with a clearer error than the one they would get anyway for not
+//declaring a scope. It has to come after frontAuthHandler in the chain
+func humanHandler(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if isAPIKeyRequest(r) {
+			WriteError(w, ErrForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+//Handlers
+
+func (c *appContext) apiKeysHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := userget(r)
+	if err != nil || user.Username == "" {
+		WriteError(w, ErrUnauthorized)
+		return
+	}
+
+	username := user.Username
+	if params, ok := context.Get(r, "params").(httprouter.Params); ok && params.ByName("username") != "" {
+		username = params.ByName("username")
+	}
+
+	repo := APIKeyRepo{c.db.C("apikeys")}
+	keys, err := repo.All(username)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+func (c *appContext) createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	body := context.Get(r, "body").(*APIKeyRequest)
+	user, err := c.currentUser(r)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrUnauthorized)
+		return
+	}
+
+	if strings.TrimSpace(body.Name) == "" {
+		WriteError(w, ErrBadRequest)
+		return
+	}
+	if !validScopes(user.Permission, body.Scopes) {
+		WriteError(w, ErrInvalidScope)
+		return
+	}
+
+	ttl := APIKeyDefaultTTL
+	if body.ExpiresIn > 0 {
+		ttl = time.Duration(body.ExpiresIn) * time.Hour * 24
+	}
+	if ttl > APIKeyMaxTTL {
+		ttl = APIKeyMaxTTL
+	}
+
+	secret, err := randToken(24)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	key := apiKeyPrefix + secret
+
+	now := time.Now()
+	apiKey := APIKey{
+		ID:      bson.NewObjectId(),
+		Name:    strings.TrimSpace(body.Name),
+		Prefix:  key[:len(apiKeyPrefix)+8],
+		Hash:    hashToken(key),
+		Owner:   user.Username,
+		Scopes:  body.Scopes,
+		Created: now,
+		Expires: now.Add(ttl),
+	}
+	err = c.db.C("apikeys").Insert(apiKey)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(NewAPIKey{apiKey, key})
+}
+
+func (c *appContext) deleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	params := context.Get(r, "params").(httprouter.Params)
+	user, err := userget(r)
+	if err != nil || user.Username == "" {
+		WriteError(w, ErrUnauthorized)
+		return
+	}
+
+	username := user.Username
+	if params.ByName("username") != "" {
+		username = params.ByName("username")
+	}
+
+	repo := APIKeyRepo{c.db.C("apikeys")}
+	err = repo.Revoke(username, params.ByName("id"))
+	if err == mgo.ErrNotFound {
+		WriteError(w, ErrNotFound)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
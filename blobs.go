@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mitchellh/goamz/s3"
+)
+
+//BlobStore keeps uploaded files, like images, and hands out the url they can be
+//fetched from. Keys are slash separated paths
+type BlobStore interface {
+	Put(key string, data []byte, contentType string) error
+	Delete(key string) error
+	URL(key string) string
+}
+
+//S3BlobStore keeps blobs in an s3 bucket, readable by anyone with the url
+type S3BlobStore struct {
+	Bucket *s3.Bucket
+}
+
+//Put uploads data under key
+func (s *S3BlobStore) Put(key string, data []byte, contentType string) error {
+	return s.Bucket.Put(key, data, contentType, s3.PublicRead)
+}
+
+//Delete removes the blob at key
+func (s *S3BlobStore) Delete(key string) error {
+	return s.Bucket.Del(key)
+}
+
+//URL is where the blob at key can be fetched from
+func (s *S3BlobStore) URL(key string) string {
+	return s.Bucket.URL(key)
+}
+
+//FileBlobStore keeps blobs as files under Dir, for running without s3. BaseURL is
+//where Dir is served from
+type FileBlobStore struct {
+	Dir     string
+	BaseURL string
+}
+
+//path is the file the blob at key lives in, keys can't climb out of Dir
+func (s *FileBlobStore) path(key string) string {
+	return filepath.Join(s.Dir, filepath.FromSlash(filepath.Clean("/"+key)))
+}
+
+//Put writes data to the file for key
+func (s *FileBlobStore) Put(key string, data []byte, contentType string) error {
+	p := s.path(key)
+	err := os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p, data, 0644)
+}
+
+//Delete removes the file for key, a file that is already gone is fine
+func (s *FileBlobStore) Delete(key string) error {
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+//URL is where the file for key is served from
+func (s *FileBlobStore) URL(key string) string {
+	return strings.TrimSuffix(s.BaseURL, "/") + "/" + strings.TrimPrefix(key, "/")
+}
+
+//blobStoreFromEnv picks where uploads go, BLOBDIR keeps them on disk and served
+//under /blobs, otherwise they go to the s3 bucket
+func blobStoreFromEnv(bucket *s3.Bucket, rootURL string) BlobStore {
+	if dir := os.Getenv("BLOBDIR"); dir != "" {
+		log.Println("Uploads are kept in", dir)
+		return &FileBlobStore{Dir: dir, BaseURL: rootURL + "/blobs"}
+	}
+	return &S3BlobStore{Bucket: bucket}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/context"
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/redis.v2"
+)
+
+// Blocks and mutes live next to the follow sets:
+//
+//	users:<name>:blocked      the users name blocked
+//	users:<name>:blocked-by   the users that blocked name
+//	users:<name>:muted        the users name muted
+//
+// a block cuts both ways, neither side can follow the other or see the
+// other's posts. a mute only hides the muted user's posts from the muter,
+// and the muted user never finds out.
+
+//Utility methods
+
+var blockRedisScript = redis.NewScript(`
+	redis.call("sadd", "users:"..KEYS[1]..":blocked", KEYS[2])
+	redis.call("sadd", "users:"..KEYS[2]..":blocked-by", KEYS[1])
+	redis.call("srem", "users:"..KEYS[1]..":following", KEYS[2])
+	redis.call("srem", "users:"..KEYS[1]..":followers", KEYS[2])
+	redis.call("srem", "users:"..KEYS[2]..":following", KEYS[1])
+	redis.call("srem", "users:"..KEYS[2]..":followers", KEYS[1])
+	return 1
+`)
+
+var unblockRedisScript = redis.NewScript(`
+	redis.call("srem", "users:"..KEYS[1]..":blocked", KEYS[2])
+	redis.call("srem", "users:"..KEYS[2]..":blocked-by", KEYS[1])
+	return 1
+`)
+
+//block makes blocker block username, and breaks any follow between them
+func (c *appContext) block(blocker, username string) error {
+	return blockRedisScript.Run(c.redis, []string{blocker, username}, []string{}).Err()
+}
+
+//unblock lifts a block, follows broken by it stay broken
+func (c *appContext) unblock(blocker, username string) error {
+	return unblockRedisScript.Run(c.redis, []string{blocker, username}, []string{}).Err()
+}
+
+var blockedBetweenRedisScript = redis.NewScript(`
+	if redis.call("sismember", "users:"..KEYS[1]..":blocked", KEYS[2]) == 1 then
+		return 1
+	end
+	return redis.call("sismember", "users:"..KEYS[2]..":blocked", KEYS[1])
+`)
+
+//blockedBetween reports whether either of a and b blocked the other
+func (c *appContext) blockedBetween(a, b string) (bool, error) {
+	resp, err := blockedBetweenRedisScript.Run(c.redis, []string{a, b}, []string{}).Result()
+	if err != nil {
+		return false, err
+	}
+	return resp.(int64) == 1, nil
+}
+
+//Handlers
+
+func (c *appContext) blockHandler(w http.ResponseWriter, r *http.Request) {
+	params := context.Get(r, "params").(httprouter.Params)
+	username := params.ByName("username")
+	user, err := userget(r)
+	if err != nil || user.Username == "" {
+		WriteError(w, ErrUnauthorized)
+		return
+	}
+	if username == user.Username {
+		WriteError(w, ErrBlockSelf)
+		return
+	}
+
+	repo := UserRepo{c.db.C("users")}
+	_, err = repo.Find(username)
+	if err == mgo.ErrNotFound {
+		WriteError(w, ErrNotFound)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	err = c.block(user.Username, username)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *appContext) unblockHandler(w http.ResponseWriter, r *http.Request) {
+	params := context.Get(r, "params").(httprouter.Params)
+	user, err := userget(r)
+	if err != nil || user.Username == "" {
+		WriteError(w, ErrUnauthorized)
+		return
+	}
+
+	err = c.unblock(user.Username, params.ByName("username"))
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *appContext) muteHandler(w http.ResponseWriter, r *http.Request) {
+	params := context.Get(r, "params").(httprouter.Params)
+	username := params.ByName("username")
+	user, err := userget(r)
+	if err != nil || user.Username == "" {
+		WriteError(w, ErrUnauthorized)
+		return
+	}
+	if username == user.Username {
+		WriteError(w, ErrBlockSelf)
+		return
+	}
+
+	repo := UserRepo{c.db.C("users")}
+	_, err = repo.Find(username)
+	if err == mgo.ErrNotFound {
+		WriteError(w, ErrNotFound)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	err = c.redis.SAdd("users:"+user.Username+":muted", username).Err()
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *appContext) unmuteHandler(w http.ResponseWriter, r *http.Request) {
+	params := context.Get(r, "params").(httprouter.Params)
+	user, err := userget(r)
+	if err != nil || user.Username == "" {
+		WriteError(w, ErrUnauthorized)
+		return
+	}
+
+	err = c.redis.SRem("users:"+user.Username+":muted", params.ByName("username")).Err()
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//relationsHandler lists a page of the users the current user blocked or muted, set
+//says which
+func (c *appContext) relationsHandler(set string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := userget(r)
+		if err != nil || user.Username == "" {
+			WriteError(w, ErrUnauthorized)
+			return
+		}
+		page, perPage := pageget(r)
+
+		key := "users:" + user.Username + ":" + set
+		names, total, err := c.usernamePage(key, page, perPage)
+		if err != nil {
+			log.Println(err)
+			WriteError(w, ErrInternalServer)
+			return
+		}
+
+		users, err := c.usersByName(names)
+		if err != nil {
+			log.Println(err)
+			WriteError(w, ErrInternalServer)
+			return
+		}
+		// muting isn't undone when the muted account is deleted
+		total -= c.pruneUsernames(key, names, users)
+
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		json.NewEncoder(w).Encode(UsersPage{
+			Data: publicUsers(users),
+			Meta: Page{Page: page, PerPage: perPage, Total: total},
+		})
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The catalog is paged with cursors rather than page numbers, so listings
+// added while someone is scrolling don't shift what they see. A cursor is
+// the position of a skill in the current sort order: its sort value and its
+// id, which breaks ties.
+const (
+	//SortNewest lists the most recently added skills first, it is the default
+	SortNewest = "newest"
+
+	//SortRating lists the best rated skills first
+	SortRating = "rating"
+
+	//SortReviews lists the most reviewed skills first
+	SortReviews = "reviews"
+
+	//MaxRating is the best rating a review can give
+	MaxRating = 5
+)
+
+var errInvalidCursor = errors.New("cursor is invalid")
+
+// the field each sort orders by, always descending
+var catalogSortFields = map[string]string{
+	SortNewest:  "timestamp",
+	SortRating:  "rating",
+	SortReviews: "reviewscount",
+}
+
+//Links holds the json api links of a paged response
+type Links struct {
+	Self string `json:"self"`
+	Next string `json:"next,omitempty"`
+	Prev string `json:"prev,omitempty"`
+}
+
+//SkillsPage is one page of the catalog, with links to the pages either side of it
+type SkillsPage struct {
+	Data  []Skill `json:"data"`
+	Links Links   `json:"links"`
+}
+
+type skillCursor struct {
+	ID        bson.ObjectId `json:"id"`
+	Timestamp time.Time     `json:"t,omitempty"`
+	N         int           `json:"n,omitempty"`
+}
+
+//Utility methods
+
+//EnsureIndexes makes the catalog filters and sorts cheap
+func (r *SkillRepo) EnsureIndexes() error {
+	keys := [][]string{
+		{"slug"}, {"owner"}, {"city"}, {"state"}, {"category"}, {"featured"},
+	}
+	for _, field := range catalogSortFields {
+		keys = append(keys, []string{"-" + field, "-_id"})
+	}
+	for _, key := range keys {
+		err := r.coll.EnsureIndexKey(key...)
+		if err != nil {
+			return err
+		}
+	}
+	return r.coll.EnsureIndexKey("$2dsphere:location")
+}
+
+//AddRating counts a new review of rating for the skill at slug, and updates its average
+func (r *SkillRepo) AddRating(slug string, rating int) error {
+	skill := Skill{}
+	_, err := r.coll.Find(bson.M{"slug": slug}).Apply(mgo.Change{
+		Update:    bson.M{"$inc": bson.M{"totalreviews": rating, "reviewscount": 1}},
+		ReturnNew: true,
+	}, &skill)
+	if err != nil {
+		return err
+	}
+
+	skill.Rating = (skill.TotalReviews + skill.ReviewsCount/2) / skill.ReviewsCount
+	err = r.coll.Update(bson.M{"slug": slug}, bson.M{"$set": bson.M{"rating": skill.Rating}})
+	if err != nil {
+		return err
+	}
+	r.index(&skill)
+	return nil
+}
+
+//hideContact takes the owner's contact details off s, they are only for whoever pays for them.
+//Its location stays, but only roughly
+func (s *Skill) hideContact() {
+	s.Phone = ""
+	s.Address = "hidden"
+	if s.Location != nil && len(s.Location.Coordinates) == 2 {
+		s.Location = NewGeoPoint(
+			roundTo(s.Location.Coordinates[1], publicLocationPrecision),
+			roundTo(s.Location.Coordinates[0], publicLocationPrecision),
+		)
+	}
+}
+
+//encodeCursor returns the cursor pointing at s in the order sort
+func encodeCursor(s *Skill, sort string) string {
+	cur := skillCursor{ID: s.ID}
+	if sort == SortNewest {
+		cur.Timestamp = s.Timestamp
+	} else if sort == SortRating {
+		cur.N = s.Rating
+	} else {
+		cur.N = s.ReviewsCount
+	}
+	x, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(x)
+}
+
+//decodeCursor reads a cursor made by encodeCursor
+func decodeCursor(s string) (*skillCursor, error) {
+	x, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	cur := &skillCursor{}
+	err = json.Unmarshal(x, cur)
+	if err != nil {
+		return nil, err
+	}
+	if !cur.ID.Valid() {
+		return nil, errInvalidCursor
+	}
+	return cur, nil
+}
+
+//value is the sort value the cursor holds for sort
+func (cur *skillCursor) value(sort string) interface{} {
+	if sort == SortNewest {
+		return cur.Timestamp
+	}
+	return cur.N
+}
+
+//catalogQuery builds the mongo query for the filters in r, a category filter takes in
+//every category under it too
+func (c *appContext) catalogQuery(r *http.Request) (bson.M, *Error) {
+	v := r.URL.Query()
+	query := bson.M{}
+
+	for _, field := range []string{"city", "state"} {
+		if s := strings.TrimSpace(v.Get(field)); s != "" {
+			query[field] = bson.RegEx{Pattern: "^" + regexp.QuoteMeta(s) + "$", Options: "i"}
+		}
+	}
+	if category := strings.ToLower(strings.TrimSpace(v.Get("category"))); category != "" {
+		filter, err := c.categoryFilter(category)
+		if err != nil {
+			log.Println(err)
+			return nil, ErrInternalServer
+		}
+		query["category"] = filter
+	}
+	if s := v.Get("min_rating"); s != "" {
+		rating, err := strconv.Atoi(s)
+		if err != nil || rating < 0 || rating > MaxRating {
+			return nil, ErrInvalidFilter
+		}
+		query["rating"] = bson.M{"$gte": rating}
+	}
+	if s := v.Get("featured"); s != "" {
+		featured, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, ErrInvalidFilter
+		}
+		if featured {
+			query["featured"] = bson.M{"$gt": 0}
+		} else {
+			query["featured"] = bson.M{"$not": bson.M{"$gt": 0}}
+		}
+	}
+	return query, nil
+}
+
+//searchCatalog returns up to perPage skills matching query in the order sort, starting
+//after the cursor after or, going backwards, ending before the cursor before. more says
+//whether there are skills past the end of the page in the direction of travel
+func (c *appContext) searchCatalog(query bson.M, sort string, after, before *skillCursor, perPage int) (skills []Skill, more bool, err error) {
+	field := catalogSortFields[sort]
+	order := []string{"-" + field, "-_id"}
+	cmp := "$lt"
+	cur := after
+	if before != nil {
+		order = []string{field, "_id"}
+		cmp = "$gt"
+		cur = before
+	}
+	if cur != nil {
+		v := cur.value(sort)
+		query["$or"] = []bson.M{
+			{field: bson.M{cmp: v}},
+			{field: v, "_id": bson.M{cmp: cur.ID}},
+		}
+	}
+
+	skills = []Skill{}
+	err = c.db.C("skills").Find(query).Sort(order...).Limit(perPage + 1).All(&skills)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(skills) > perPage {
+		skills, more = skills[:perPage], true
+	}
+	if before != nil {
+		for i, j := 0, len(skills)-1; i < j; i, j = i+1, j-1 {
+			skills[i], skills[j] = skills[j], skills[i]
+		}
+	}
+	return skills, more, nil
+}
+
+//catalogLink is the url of r with its cursor swapped for key=cursor
+func catalogLink(r *http.Request, key, cursor string) string {
+	v := r.URL.Query()
+	v.Del("after")
+	v.Del("before")
+	v.Set(key, cursor)
+	return r.URL.Path + "?" + v.Encode()
+}
+
+//Handlers
+
+//skillsHandler is the public catalog, anyone can browse it
+func (c *appContext) skillsHandler(w http.ResponseWriter, r *http.Request) {
+	query, e := c.catalogQuery(r)
+	if e != nil {
+		WriteError(w, e)
+		return
+	}
+	if r.URL.Query().Get("near") != "" {
+		c.nearSkillsHandler(w, r, query)
+		return
+	}
+
+	_, perPage := pageget(r)
+	sort := r.URL.Query().Get("sort")
+	if sort == "" {
+		sort = SortNewest
+	}
+	if _, ok := catalogSortFields[sort]; !ok {
+		WriteError(w, ErrInvalidFilter)
+		return
+	}
+
+	var after, before *skillCursor
+	var err error
+	if s := r.URL.Query().Get("after"); s != "" {
+		after, err = decodeCursor(s)
+	} else if s := r.URL.Query().Get("before"); s != "" {
+		before, err = decodeCursor(s)
+	}
+	if err != nil {
+		WriteError(w, ErrInvalidFilter)
+		return
+	}
+
+	skills, more, err := c.searchCatalog(query, sort, after, before, perPage)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	result := SkillsPage{Data: skills, Links: Links{Self: r.URL.RequestURI()}}
+	for i := range result.Data {
+		result.Data[i].hideContact()
+	}
+	if len(skills) > 0 {
+		if more || before != nil {
+			result.Links.Next = catalogLink(r, "after", encodeCursor(&skills[len(skills)-1], sort))
+		}
+		if after != nil || (before != nil && more) {
+			result.Links.Prev = catalogLink(r, "before", encodeCursor(&skills[0], sort))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/extemporalgenome/slug"
+	"github.com/gorilla/context"
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Categories form a tree, like Home Services > Plumbing. Every category
+// keeps its path from the top of the tree, its own slug last, so finding
+// everything under a category is a single query on path. Skills only store
+// the slug of the category they are in.
+const (
+	//MaxCategoryDepth is how deep the category tree can go
+	MaxCategoryDepth = 4
+
+	maxCategoryNameLength = 64
+)
+
+//Category is a node in the category tree
+type Category struct {
+	ID          bson.ObjectId `json:"-" bson:"_id,omitempty"`
+	Slug        string        `json:"slug"`
+	Name        string        `json:"name"`
+	Parent      string        `json:"parent,omitempty" bson:"parent,omitempty"`
+	Path        []string      `json:"path"`
+	SkillsCount int           `json:"skills_count" bson:"-"`
+	Children    []*Category   `json:"children,omitempty" bson:"-"`
+}
+
+// what an empty tree starts out with, parents before their children
+var defaultCategories = []Category{
+	{Slug: "home-services", Name: "Home Services"},
+	{Slug: "plumbing", Name: "Plumbing", Parent: "home-services"},
+	{Slug: "electrical", Name: "Electrical", Parent: "home-services"},
+	{Slug: "carpentry", Name: "Carpentry", Parent: "home-services"},
+	{Slug: "painting", Name: "Painting", Parent: "home-services"},
+	{Slug: "cleaning", Name: "Cleaning", Parent: "home-services"},
+	{Slug: "beauty", Name: "Beauty & Wellness"},
+	{Slug: "hair", Name: "Hair", Parent: "beauty"},
+	{Slug: "makeup", Name: "Makeup", Parent: "beauty"},
+	{Slug: "tailoring", Name: "Tailoring", Parent: "beauty"},
+	{Slug: "repairs", Name: "Repairs"},
+	{Slug: "phone-repair", Name: "Phone Repair", Parent: "repairs"},
+	{Slug: "computer-repair", Name: "Computer Repair", Parent: "repairs"},
+	{Slug: "auto-repair", Name: "Auto Repair", Parent: "repairs"},
+	{Slug: "events", Name: "Events"},
+	{Slug: "catering", Name: "Catering", Parent: "events"},
+	{Slug: "photography", Name: "Photography", Parent: "events"},
+	{Slug: "lessons", Name: "Lessons & Tutoring"},
+	{Slug: "moving", Name: "Moving & Delivery"},
+}
+
+//CategoriesCollection holds the top of the category tree under the key "data"
+type CategoriesCollection struct {
+	Data []*Category `json:"data"`
+}
+
+//CategoryResource carries a single category under the key "data"
+type CategoryResource struct {
+	Data Category `json:"data"`
+}
+
+//CategoryRepo is the mongo collection categories live in
+type CategoryRepo struct {
+	coll *mgo.Collection
+}
+
+//Utility methods
+
+//EnsureIndexes makes slugs unique and subtree lookups cheap
+func (r *CategoryRepo) EnsureIndexes() error {
+	err := r.coll.EnsureIndex(mgo.Index{Key: []string{"slug"}, Unique: true})
+	if err != nil {
+		return err
+	}
+	return r.coll.EnsureIndexKey("path")
+}
+
+//Seed fills an empty tree with the default categories
+func (r *CategoryRepo) Seed() error {
+	n, err := r.coll.Count()
+	if err != nil || n > 0 {
+		return err
+	}
+
+	paths := map[string][]string{}
+	for _, d := range defaultCategories {
+		category := d
+		category.Path = append(append([]string{}, paths[d.Parent]...), d.Slug)
+		paths[d.Slug] = category.Path
+		err = r.Create(&category)
+		if err != nil && !mgo.IsDup(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+//All returns every category, ordered by name
+func (r *CategoryRepo) All() ([]Category, error) {
+	result := []Category{}
+	err := r.coll.Find(nil).Sort("name").All(&result)
+	return result, err
+}
+
+//Find returns the category with slug
+func (r *CategoryRepo) Find(slug string) (Category, error) {
+	result := Category{}
+	err := r.coll.Find(bson.M{"slug": slug}).One(&result)
+	return result, err
+}
+
+//Subtree returns the slugs of category and of every category under it
+func (r *CategoryRepo) Subtree(slug string) ([]string, error) {
+	found := []Category{}
+	err := r.coll.Find(bson.M{"path": slug}).Select(bson.M{"slug": 1}).All(&found)
+	if err != nil {
+		return nil, err
+	}
+	slugs := []string{}
+	for _, c := range found {
+		slugs = append(slugs, c.Slug)
+	}
+	return slugs, nil
+}
+
+//Create adds category under its parent
+func (r *CategoryRepo) Create(category *Category) error {
+	category.ID = bson.NewObjectId()
+	return r.coll.Insert(category)
+}
+
+//Move renames category and puts it under parent, along with everything under it
+func (r *CategoryRepo) Move(category *Category, name string, parent *Category) error {
+	path := []string{category.Slug}
+	parentSlug := ""
+	if parent != nil {
+		path = append(append([]string{}, parent.Path...), category.Slug)
+		parentSlug = parent.Slug
+	}
+
+	err := r.coll.UpdateId(category.ID, bson.M{"$set": bson.M{
+		"name":   name,
+		"parent": parentSlug,
+		"path":   path,
+	}})
+	if err != nil {
+		return err
+	}
+
+	// everything under the category keeps the part of its path from the
+	// category down, and gets the new path above that
+	below := []Category{}
+	err = r.coll.Find(bson.M{"path": category.Slug, "_id": bson.M{"$ne": category.ID}}).All(&below)
+	if err != nil {
+		return err
+	}
+	depth := len(category.Path) - 1
+	for _, c := range below {
+		newPath := append(append([]string{}, path...), c.Path[depth+1:]...)
+		err = r.coll.UpdateId(c.ID, bson.M{"$set": bson.M{"path": newPath}})
+		if err != nil {
+			return err
+		}
+	}
+
+	category.Name, category.Parent, category.Path = name, parentSlug, path
+	return nil
+}
+
+//Delete removes the category with slug
+func (r *CategoryRepo) Delete(slug string) error {
+	return r.coll.Remove(bson.M{"slug": slug})
+}
+
+//adoptLegacyCategories files the categories skills were given before there was a tree
+//into it, at the top, so they can be browsed and moved where they belong. Skills get
+//their category slugged on the way
+func (c *appContext) adoptLegacyCategories() error {
+	legacy := []string{}
+	err := c.db.C("skills").Find(nil).Distinct("category", &legacy)
+	if err != nil {
+		return err
+	}
+
+	repo := CategoryRepo{c.db.C("categories")}
+	for _, name := range legacy {
+		s := slug.Slug(name)
+		if s == "" {
+			continue
+		}
+		if s != name {
+			_, err = c.db.C("skills").UpdateAll(bson.M{"category": name}, bson.M{"$set": bson.M{"category": s}})
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = repo.Find(s)
+		if err != mgo.ErrNotFound {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		err = repo.Create(&Category{Slug: s, Name: strings.TrimSpace(name), Path: []string{s}})
+		if err != nil && !mgo.IsDup(err) {
+			return err
+		}
+		log.Println("added legacy category", s)
+	}
+	return nil
+}
+
+//categorySkills is how many skills sit directly in each category
+func (c *appContext) categorySkills() (map[string]int, error) {
+	counts := []struct {
+		Category string `bson:"_id"`
+		Count    int    `bson:"count"`
+	}{}
+	err := c.db.C("skills").Pipe([]bson.M{
+		{"$group": bson.M{"_id": "$category", "count": bson.M{"$sum": 1}}},
+	}).All(&counts)
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string]int{}
+	for _, n := range counts {
+		result[n.Category] = n.Count
+	}
+	return result, nil
+}
+
+//categoryTree builds the category tree, every category counting the skills in it and
+//everything under it. It returns the top of the tree and every category by slug
+func (c *appContext) categoryTree() ([]*Category, map[string]*Category, error) {
+	repo := CategoryRepo{c.db.C("categories")}
+	all, err := repo.All()
+	if err != nil {
+		return nil, nil, err
+	}
+	counts, err := c.categorySkills()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	bySlug := map[string]*Category{}
+	for i := range all {
+		bySlug[all[i].Slug] = &all[i]
+	}
+
+	roots := []*Category{}
+	for i := range all {
+		cat := &all[i]
+		for _, s := range cat.Path {
+			if up, ok := bySlug[s]; ok {
+				up.SkillsCount += counts[cat.Slug]
+			}
+		}
+		if parent, ok := bySlug[cat.Parent]; ok {
+			parent.Children = append(parent.Children, cat)
+		} else {
+			roots = append(roots, cat)
+		}
+	}
+	return roots, bySlug, nil
+}
+
+//categoryFilter is the catalog query for the skills in category or anywhere under it
+func (c *appContext) categoryFilter(category string) (bson.M, error) {
+	repo := CategoryRepo{c.db.C("categories")}
+	slugs, err := repo.Subtree(category)
+	if err != nil {
+		return nil, err
+	}
+	if len(slugs) == 0 {
+		slugs = []string{category}
+	}
+	return bson.M{"$in": slugs}, nil
+}
+
+//validCategory reports whether a skill may be filed under the category with slug
+func (c *appContext) validCategory(slug string) (bool, error) {
+	repo := CategoryRepo{c.db.C("categories")}
+	_, err := repo.Find(slug)
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+//categoryParent loads the category called parent for a category to go under, nil when
+//there is no parent. It writes the error response and returns false if it can't
+func (c *appContext) categoryParent(w http.ResponseWriter, parent string) (*Category, bool) {
+	if parent == "" {
+		return nil, true
+	}
+	repo := CategoryRepo{c.db.C("categories")}
+	p, err := repo.Find(parent)
+	if err == mgo.ErrNotFound {
+		WriteError(w, ErrInvalidCategory)
+		return nil, false
+	}
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return nil, false
+	}
+	if len(p.Path) >= MaxCategoryDepth {
+		WriteError(w, ErrInvalidCategory)
+		return nil, false
+	}
+	return &p, true
+}
+
+//validCategoryName reports whether name is fine for a category
+func validCategoryName(name string) bool {
+	return name != "" && utf8.RuneCountInString(name) <= maxCategoryNameLength
+}
+
+//Handlers
+
+//categoriesHandler returns the whole category tree
+func (c *appContext) categoriesHandler(w http.ResponseWriter, r *http.Request) {
+	roots, _, err := c.categoryTree()
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	json.NewEncoder(w).Encode(CategoriesCollection{roots})
+}
+
+//categoryHandler returns one category and everything under it
+func (c *appContext) categoryHandler(w http.ResponseWriter, r *http.Request) {
+	params := context.Get(r, "params").(httprouter.Params)
+	_, bySlug, err := c.categoryTree()
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	category, ok := bySlug[params.ByName("slug")]
+	if !ok {
+		WriteError(w, ErrNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	json.NewEncoder(w).Encode(CategoryResource{*category})
+}
+
+func (c *appContext) createCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	body := context.Get(r, "body").(*CategoryResource)
+	name := strings.TrimSpace(body.Data.Name)
+	if !validCategoryName(name) {
+		WriteError(w, ErrInvalidCategory)
+		return
+	}
+	parent, ok := c.categoryParent(w, body.Data.Parent)
+	if !ok {
+		return
+	}
+
+	category := Category{Name: name, Slug: slug.Slug(body.Data.Slug)}
+	if category.Slug == "" {
+		category.Slug = slug.Slug(name)
+	}
+	// a name with nothing a slug can be made of, like "!!!"
+	if category.Slug == "" {
+		WriteError(w, ErrInvalidCategory)
+		return
+	}
+	category.Path = []string{category.Slug}
+	if parent != nil {
+		category.Parent = parent.Slug
+		category.Path = append(append([]string{}, parent.Path...), category.Slug)
+	}
+
+	repo := CategoryRepo{c.db.C("categories")}
+	err := repo.Create(&category)
+	if mgo.IsDup(err) {
+		WriteError(w, ErrCategoryTaken)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CategoryResource{category})
+}
+
+//updateCategoryHandler renames a category or moves it, its slug never changes so the
+//skills in it stay put
+func (c *appContext) updateCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	params := context.Get(r, "params").(httprouter.Params)
+	body := context.Get(r, "body").(*CategoryResource)
+	repo := CategoryRepo{c.db.C("categories")}
+	category, err := repo.Find(params.ByName("slug"))
+	if err == mgo.ErrNotFound {
+		WriteError(w, ErrNotFound)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	name := strings.TrimSpace(body.Data.Name)
+	if !validCategoryName(name) {
+		WriteError(w, ErrInvalidCategory)
+		return
+	}
+	parent, ok := c.categoryParent(w, body.Data.Parent)
+	if !ok {
+		return
+	}
+	if parent != nil {
+		// a category can't go under itself, or anything under it
+		for _, s := range parent.Path {
+			if s == category.Slug {
+				WriteError(w, ErrInvalidCategory)
+				return
+			}
+		}
+
+		// and whatever is under it has to stay within the depth limit
+		below := []Category{}
+		err = c.db.C("categories").Find(bson.M{"path": category.Slug}).Select(bson.M{"path": 1}).All(&below)
+		if err != nil {
+			log.Println(err)
+			WriteError(w, ErrInternalServer)
+			return
+		}
+		for _, b := range below {
+			if len(parent.Path)+len(b.Path)-len(category.Path)+1 > MaxCategoryDepth {
+				WriteError(w, ErrInvalidCategory)
+				return
+			}
+		}
+	}
+
+	err = repo.Move(&category, name, parent)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(CategoryResource{category})
+}
+
+//deleteCategoryHandler removes a category, as long as nothing is filed under it
+func (c *appContext) deleteCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	params := context.Get(r, "params").(httprouter.Params)
+	categorySlug := params.ByName("slug")
+	repo := CategoryRepo{c.db.C("categories")}
+
+	subtree, err := repo.Subtree(categorySlug)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	if len(subtree) == 0 {
+		WriteError(w, ErrNotFound)
+		return
+	}
+	skills, err := c.db.C("skills").Find(bson.M{"category": categorySlug}).Count()
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	if len(subtree) > 1 || skills > 0 {
+		WriteError(w, ErrCategoryInUse)
+		return
+	}
+
+	err = repo.Delete(categorySlug)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
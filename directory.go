@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	//DirectoryCandidates caps how many users a fuzzy search ranks before paging
+	DirectoryCandidates = 500
+
+	maxQueryLength = 64
+)
+
+//UsersPage is a page of public users
+type UsersPage struct {
+	Data []PublicUser `json:"data"`
+	Meta Page         `json:"meta"`
+}
+
+// only what PublicUser shows ever gets loaded for the directory
+var publicUserFields = bson.M{
+	"username": 1, "name": 1, "image": 1, "avatar": 1, "bio": 1, "city": 1, "link": 1, "permission": 1,
+}
+
+//Utility methods
+
+//EnsureIndexes makes the lookups the directory does cheap, and makes sure no two users
+//ever end up with the same username
+func (r *UserRepo) EnsureIndexes() error {
+	for _, key := range []string{"city", "permission"} {
+		err := r.coll.EnsureIndexKey(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	indexes, err := r.coll.Indexes()
+	if err != nil {
+		return err
+	}
+	for _, index := range indexes {
+		if index.Name != "username_1" {
+			continue
+		}
+		// the unique index replaces the plain one, and is sparse so the users
+		// still onboarding don't clash, which needs their empty usernames gone
+		err = r.coll.DropIndex("username")
+		if err != nil {
+			return err
+		}
+		_, err = r.coll.UpdateAll(bson.M{"username": ""}, bson.M{"$unset": bson.M{"username": ""}})
+		if err != nil {
+			return err
+		}
+	}
+	return r.coll.EnsureIndex(mgo.Index{
+		Key:    []string{"username"},
+		Unique: true,
+		Sparse: true,
+		Name:   "username_unique",
+	})
+}
+
+//fuzzyPattern matches anything containing the letters of q in order, so "jdoe" finds
+//"john doe"
+func fuzzyPattern(q string) string {
+	parts := []string{}
+	for _, r := range q {
+		if r == ' ' {
+			continue
+		}
+		parts = append(parts, regexp.QuoteMeta(string(r)))
+	}
+	// each gap only skips what can't be the next letter, so a miss fails
+	// in one pass instead of backtracking through every split of the name
+	pattern := ""
+	for i, part := range parts {
+		if i > 0 {
+			pattern += "[^" + part + "]*"
+		}
+		pattern += part
+	}
+	return pattern
+}
+
+//directoryScore ranks how well u matches q, higher is better
+func directoryScore(u *User, q string) int {
+	username := strings.ToLower(u.Username)
+	name := strings.ToLower(u.Name)
+	switch {
+	case username == q:
+		return 4
+	case strings.HasPrefix(username, q):
+		return 3
+	case strings.HasPrefix(name, q) || strings.Contains(name, " "+q):
+		return 2
+	}
+	return 1
+}
+
+type byDirectoryScore struct {
+	users  []User
+	scores []int
+}
+
+func (s byDirectoryScore) Len() int { return len(s.users) }
+func (s byDirectoryScore) Swap(i, j int) {
+	s.users[i], s.users[j] = s.users[j], s.users[i]
+	s.scores[i], s.scores[j] = s.scores[j], s.scores[i]
+}
+func (s byDirectoryScore) Less(i, j int) bool {
+	if s.scores[i] != s.scores[j] {
+		return s.scores[i] > s.scores[j]
+	}
+	return s.users[i].Username < s.users[j].Username
+}
+
+//directoryQuery builds the mongo query for the filters in r, leaving out deleted accounts,
+//accounts that never finished signing up and anyone who blocked the viewer
+func (c *appContext) directoryQuery(r *http.Request, viewer string) bson.M {
+	query := bson.M{
+		"deletedat": bson.M{"$exists": false},
+		"username":  bson.M{"$nin": []interface{}{"", nil}},
+	}
+
+	if city := strings.TrimSpace(r.URL.Query().Get("city")); city != "" {
+		query["city"] = bson.RegEx{Pattern: "^" + regexp.QuoteMeta(city) + "$", Options: "i"}
+	}
+	if role := r.URL.Query().Get("role"); role != "" {
+		if role == RoleCustomer {
+			query["permission"] = bson.M{"$in": []interface{}{RoleCustomer, "", nil}}
+		} else {
+			query["permission"] = role
+		}
+	}
+
+	if viewer != "" {
+		blockedBy, err := c.redis.SMembers("users:" + viewer + ":blocked-by").Result()
+		if err != nil {
+			log.Println(err)
+		}
+		if len(blockedBy) > 0 {
+			query["$and"] = []bson.M{{"username": bson.M{"$nin": blockedBy}}}
+		}
+	}
+	return query
+}
+
+//searchUsers returns a page of the users matching q and the filters in r, best matches
+//first. Without q it is just the filtered users by username
+func (c *appContext) searchUsers(r *http.Request, q, viewer string, page, perPage int) ([]User, int64, error) {
+	coll := c.db.C("users")
+	query := c.directoryQuery(r, viewer)
+
+	if q == "" {
+		users := []User{}
+		n, err := coll.Find(query).Count()
+		if err != nil {
+			return nil, 0, err
+		}
+		err = coll.Find(query).Select(publicUserFields).Sort("username").
+			Skip((page - 1) * perPage).Limit(perPage).All(&users)
+		return users, int64(n), err
+	}
+
+	// usernames starting with q come first, that query runs off the index
+	prefix := "^" + regexp.QuoteMeta(strings.ToLower(strings.Replace(q, " ", "", -1)))
+	candidates := []User{}
+	err := coll.Find(bson.M{"$and": []bson.M{query, {"username": bson.RegEx{Pattern: prefix}}}}).
+		Select(publicUserFields).Sort("username").Limit(DirectoryCandidates).All(&candidates)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// the rest of the candidates are the fuzzy matches
+	if len(candidates) < DirectoryCandidates {
+		seen := make([]string, len(candidates))
+		for i := range candidates {
+			seen[i] = candidates[i].Username
+		}
+		pattern := bson.RegEx{Pattern: fuzzyPattern(q), Options: "i"}
+		fuzzy := []User{}
+		err = coll.Find(bson.M{"$and": []bson.M{
+			query,
+			{"username": bson.M{"$nin": seen}},
+			{"$or": []bson.M{{"username": pattern}, {"name": pattern}}},
+		}}).Select(publicUserFields).Sort("username").Limit(DirectoryCandidates - len(candidates)).All(&fuzzy)
+		if err != nil {
+			return nil, 0, err
+		}
+		candidates = append(candidates, fuzzy...)
+	}
+
+	scores := make([]int, len(candidates))
+	for i := range candidates {
+		scores[i] = directoryScore(&candidates[i], q)
+	}
+	sort.Sort(byDirectoryScore{candidates, scores})
+
+	// past the cap only the first candidates get ranked, so only they are
+	// counted, the pages then add up to the total
+	total := int64(len(candidates))
+	start := (page - 1) * perPage
+	if start > len(candidates) {
+		start = len(candidates)
+	}
+	end := start + perPage
+	if end > len(candidates) {
+		end = len(candidates)
+	}
+	return candidates[start:end], total, nil
+}
+
+//Handlers
+
+func (c *appContext) usersHandler(w http.ResponseWriter, r *http.Request) {
+	viewer, _ := userget(r)
+	page, perPage := pageget(r)
+	q := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("q")))
+	if len(q) > maxQueryLength {
+		WriteError(w, ErrBadRequest)
+		return
+	}
+	if role := r.URL.Query().Get("role"); role != "" {
+		if _, ok := roleRank[role]; !ok {
+			WriteError(w, ErrInvalidRole)
+			return
+		}
+	}
+
+	users, total, err := c.searchUsers(r, q, viewer.Username, page, perPage)
+	if err != nil && err != mgo.ErrNotFound {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	c.checkFollowedState(users, viewer.Username)
+
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	json.NewEncoder(w).Encode(UsersPage{
+		Data: publicUsers(users),
+		Meta: Page{Page: page, PerPage: perPage, Total: total},
+	})
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestFuzzyPattern(t *testing.T) {
+	tests := []struct {
+		q, text string
+		want    bool
+	}{
+		{"jdoe", "john doe", true},
+		{"jdoe", "jane doe", true},
+		{"jdoe", "doe john", false},
+		{"j doe", "johndoe", true},
+		{"aa", "banana", true},
+		{"aaaa", "banana", false},
+		{"j.d", "j.doe", true},
+		{"j.d", "jxd", false},
+		{"a]b", "a]b", true},
+		{"a^b", "xa^yb", true},
+		{"a-b", "a-b", true},
+		{"ada", "", false},
+	}
+	for _, tt := range tests {
+		re := regexp.MustCompile(fuzzyPattern(tt.q))
+		if got := re.MatchString(tt.text); got != tt.want {
+			t.Errorf("fuzzyPattern(%q) = %q matching %q = %v, want %v", tt.q, fuzzyPattern(tt.q), tt.text, got, tt.want)
+		}
+	}
+}
@@ -31,5 +31,56 @@ var (
 	ErrBadRequest           = &Error{"bad_request", 400, "Bad request", "Request body is not well-formed. It must be JSON."}
 	ErrNotAcceptable        = &Error{"not_acceptable", 406, "Not Acceptable", "Accept header must be set to 'application/vnd.api+json'."}
 	ErrUnsupportedMediaType = &Error{"unsupported_media_type", 415, "Unsupported Media Type", "Content-Type header must be set to: 'application/vnd.api+json'."}
+	ErrNotFound             = &Error{"not_found", 404, "Not Found", "The requested resource could not be found."}
 	ErrInternalServer       = &Error{"internal_server_error", 500, "Internal Server Error", "Something went wrong."}
+
+	// authentication
+	ErrUnauthorized             = &Error{"unauthorized", 401, "Unauthorized", "A valid access token is required."}
+	ErrTokenExpired             = &Error{"token_expired", 401, "Token expired", "The access token has expired, use the refresh token to get a new one."}
+	ErrForbidden                = &Error{"forbidden", 403, "Forbidden", "You are not allowed to do this."}
+	ErrTokenRevoked             = &Error{"token_revoked", 401, "Token revoked", "This token has been revoked, sign in again."}
+	ErrInvalidRefreshToken      = &Error{"invalid_refresh_token", 401, "Invalid refresh token", "The refresh token is invalid, expired or has already been used."}
+	ErrEmailNotVerified         = &Error{"email_not_verified", 403, "Email not verified", "Verify your email address before doing this."}
+	ErrInvalidVerificationToken = &Error{"invalid_verification_token", 400, "Invalid verification token", "The verification link is invalid, expired or has already been used."}
+	ErrInvalidResetToken        = &Error{"invalid_reset_token", 400, "Invalid reset token", "The password reset link is invalid, expired or has already been used."}
+	ErrInvalidRole              = &Error{"invalid_role", 422, "Invalid role", "Role must be one of customer, provider, moderator or admin."}
+	ErrAlreadyProvider          = &Error{"already_provider", 409, "Already a provider", "This account can already list skills."}
+	ErrInvalidCredentials       = &Error{"invalid_credentials", 401, "Invalid credentials", "The email or password is incorrect."}
+	ErrTooManyAttempts          = &Error{"too_many_attempts", 429, "Too many attempts", "Too many failed sign in attempts, wait a while before trying again."}
+	ErrAccountLocked            = &Error{"account_locked", 423, "Account locked", "This account is locked after too many failed sign in attempts."}
+	ErrInvalidChallenge         = &Error{"invalid_challenge", 401, "Invalid challenge", "The sign in challenge is invalid or has expired, sign in again."}
+	ErrInvalidSecondFactor      = &Error{"invalid_second_factor", 401, "Invalid code", "The two factor code is incorrect or has already been used."}
+	ErrTwoFactorEnabled         = &Error{"two_factor_enabled", 409, "Two factor already enabled", "Two factor authentication is already turned on for this account."}
+	ErrProviderAuth             = &Error{"provider_auth_failed", 401, "Provider authentication failed", "The id token from the login provider could not be verified."}
+	ErrPasswordTooShort         = &Error{"password_too_short", 422, "Password too short", "Passwords must be at least 8 characters long."}
+	ErrEmailTaken               = &Error{"email_taken", 409, "Email taken", "An account with this email already exists, sign in or reset its password instead."}
+	ErrIdentityTaken            = &Error{"identity_taken", 409, "Identity taken", "This login is already linked to another account."}
+	ErrLastLoginMethod          = &Error{"last_login_method", 409, "Last login method", "An account needs at least one way to sign in, link another before removing this one."}
+	ErrInvalidAPIKey            = &Error{"invalid_api_key", 401, "Invalid API key", "The API key is invalid, expired or has been revoked."}
+	ErrInvalidScope             = &Error{"invalid_scope", 422, "Invalid scope", "API keys need at least one scope, and can only be given permissions their owner has."}
+	ErrInvalidPhone             = &Error{"invalid_phone", 422, "Invalid phone number", "The phone number is not valid, include the country code."}
+	ErrInvalidOTP               = &Error{"invalid_otp", 401, "Invalid code", "The code is incorrect or has expired, ask for a new one."}
+	ErrAccountDeleted           = &Error{"account_deleted", 410, "Account deleted", "This account has been deleted."}
+	ErrInvalidUsername          = &Error{"invalid_username", 422, "Invalid username", "Usernames are 3 to 30 lowercase letters, digits, dots, dashes or underscores, starting and ending with a letter or digit."}
+	ErrUsernameTaken            = &Error{"username_taken", 409, "Username taken", "That username is not available."}
+	ErrUsernameAlreadySet       = &Error{"username_already_set", 409, "Username already set", "This account already has a username."}
+	ErrInvalidProfile           = &Error{"invalid_profile", 422, "Invalid profile", "Names are 1 to 100 characters, bios up to 500, and images and links must be http or https urls."}
+
+	// users
+	ErrFollowSelf = &Error{"follow_self", 422, "Can't follow yourself", "Users can't follow themselves."}
+	ErrBlockSelf  = &Error{"block_self", 422, "Can't block yourself", "Users can't block or mute themselves."}
+	ErrBlocked    = &Error{"blocked", 403, "Blocked", "You can't interact with this user."}
+
+	// skills
+	ErrInvalidFilter   = &Error{"invalid_filter", 422, "Invalid filter", "A filter, sort or cursor in the query is not valid."}
+	ErrInvalidRating   = &Error{"invalid_rating", 422, "Invalid rating", "Ratings are whole numbers from 1 to 5."}
+	ErrInvalidLocation = &Error{"invalid_location", 422, "Invalid location", "Locations are a latitude and longitude, and radiuses up to 100 km."}
+	ErrInvalidCategory = &Error{"invalid_category", 422, "Invalid category", "Skills need an existing category, and categories a name of up to 64 characters and a parent no more than 3 levels deep."}
+	ErrCategoryTaken   = &Error{"category_taken", 409, "Category taken", "A category with that slug already exists."}
+	ErrCategoryInUse   = &Error{"category_in_use", 409, "Category in use", "Only categories with no skills or categories under them can be deleted."}
+
+	// uploads
+	ErrInvalidImage  = &Error{"invalid_image", 422, "Invalid image", "Upload a JPEG or PNG of up to 25 megapixels in the form field \"image\"."}
+	ErrImageTooLarge = &Error{"image_too_large", 413, "Image too large", "Images can be up to 10 MB."}
+	ErrTooManyImages = &Error{"too_many_images", 409, "Too many images", "A skill can have up to 10 images, delete one first."}
 )
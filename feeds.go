@@ -4,10 +4,19 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"strconv"
 
 	"gopkg.in/redis.v2"
 )
 
+const (
+	//FeedPageSize is how many posts a timeline shows
+	FeedPageSize = 10
+
+	//FeedScanLimit is how far down the timeline we look for posts the viewer can see
+	FeedScanLimit = 200
+)
+
 //Feed helps me serialize feed data to store in redis
 type Feed struct {
 	Type      string `json:"type"`
@@ -64,22 +73,42 @@ func (c *appContext) newReviewFeed(review *Review) {
 func (c *appContext) userFeedsHandler(w http.ResponseWriter, r *http.Request) {
 	user, _ := userget(r)
 
+	// walks the timeline until it has a page of posts, skipping the ones
+	// by users the viewer blocked, was blocked by or muted
 	FeedsRedisScript := redis.NewScript(`
-		local ids = redis.call("lrange", "users:"..KEYS[1]..":timeline", 0, 9)
-		-- print(unpack(ids))
+		local hidden = {
+			"users:"..KEYS[1]..":blocked",
+			"users:"..KEYS[1]..":blocked-by",
+			"users:"..KEYS[1]..":muted",
+		}
+		local ids = redis.call("lrange", "users:"..KEYS[1]..":timeline", 0, tonumber(ARGV[2]) - 1)
 
-		local nlist = {}
+		local x = {}
 
 		for i=1,#ids do
-			nlist[i] = "posts:"..ids[i]
+			if #x >= tonumber(ARGV[1]) then
+				break
+			end
+			local post = redis.call("get", "posts:"..ids[i])
+			if post then
+				local ok, feed = pcall(cjson.decode, post)
+				local author = ok and feed["subjectid"] or ""
+				local visible = true
+				for j=1,#hidden do
+					if redis.call("sismember", hidden[j], author) == 1 then
+						visible = false
+					end
+				end
+				if visible then
+					table.insert(x, post)
+				end
+			end
 		end
 
-		local x = redis.call("mget", unpack(nlist))
-
 		return x
 	`)
 	log.Println(user.Username)
-	resp, err := FeedsRedisScript.Run(c.redis, []string{user.Username}, []string{"fffg"}).Result()
+	resp, err := FeedsRedisScript.Run(c.redis, []string{user.Username}, []string{strconv.Itoa(FeedPageSize), strconv.Itoa(FeedScanLimit)}).Result()
 	if err != nil {
 		log.Println(resp, err)
 
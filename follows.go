@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/context"
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/redis.v2"
+)
+
+// Who follows whom lives in redis, in two sets per user:
+//
+//	users:<name>:followers   the users following name
+//	users:<name>:following   the users name follows
+//
+// the feed fans posts out to the followers set, so both sides always have
+// to change together.
+const (
+	//DefaultPageSize is how many items a page holds when the client doesn't say
+	DefaultPageSize = 20
+
+	//MaxPageSize is the most items a client can ask for in one page
+	MaxPageSize = 100
+)
+
+//Page describes which slice of a list a response carries
+type Page struct {
+	Page    int   `json:"page"`
+	PerPage int   `json:"per_page"`
+	Total   int64 `json:"total"`
+}
+
+//Utility methods
+
+//pageget reads ?page= and ?per_page= from r, pages start at 1
+func pageget(r *http.Request) (page, perPage int) {
+	page, _ = strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	perPage, _ = strconv.Atoi(r.URL.Query().Get("per_page"))
+	if perPage < 1 {
+		perPage = DefaultPageSize
+	}
+	if perPage > MaxPageSize {
+		perPage = MaxPageSize
+	}
+	return page, perPage
+}
+
+var followRedisScript = redis.NewScript(`
+	local added = redis.call("sadd", "users:"..KEYS[1]..":following", KEYS[2])
+	redis.call("sadd", "users:"..KEYS[2]..":followers", KEYS[1])
+	return added
+`)
+
+var unfollowRedisScript = redis.NewScript(`
+	local removed = redis.call("srem", "users:"..KEYS[1]..":following", KEYS[2])
+	redis.call("srem", "users:"..KEYS[2]..":followers", KEYS[1])
+	return removed
+`)
+
+//follow makes follower follow followee
+func (c *appContext) follow(follower, followee string) error {
+	return followRedisScript.Run(c.redis, []string{follower, followee}, []string{}).Err()
+}
+
+//unfollow makes follower stop following followee
+func (c *appContext) unfollow(follower, followee string) error {
+	return unfollowRedisScript.Run(c.redis, []string{follower, followee}, []string{}).Err()
+}
+
+// returns {total, names} for one page of a set of usernames, sorted by name
+var usernamePageRedisScript = redis.NewScript(`
+	local total = redis.call("scard", KEYS[1])
+	local names = redis.call("sort", KEYS[1], "ALPHA", "LIMIT", ARGV[1], ARGV[2])
+	return {total, names}
+`)
+
+//usernamePage returns one page of the usernames in the set at key, and how many there are
+func (c *appContext) usernamePage(key string, page, perPage int) ([]string, int64, error) {
+	offset := strconv.Itoa((page - 1) * perPage)
+	resp, err := usernamePageRedisScript.Run(c.redis, []string{key}, []string{offset, strconv.Itoa(perPage)}).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	fields := resp.([]interface{})
+	names := []string{}
+	for _, n := range fields[1].([]interface{}) {
+		names = append(names, n.(string))
+	}
+	return names, fields[0].(int64), nil
+}
+
+// returns {followers, following, is_following} for every user in ARGV, as
+// seen by KEYS[1], who may be nobody
+var followStateRedisScript = redis.NewScript(`
+	local result = {}
+	for i=1,#ARGV do
+		local following = 0
+		if KEYS[1] ~= "" then
+			following = redis.call("sismember", "users:"..KEYS[1]..":following", ARGV[i])
+		end
+		table.insert(result, {
+			redis.call("scard", "users:"..ARGV[i]..":followers"),
+			redis.call("scard", "users:"..ARGV[i]..":following"),
+			following,
+		})
+	end
+	return result
+`)
+
+//checkFollowedState fills in the follow counts of users, and whether username follows them
+func (c *appContext) checkFollowedState(users []User, username string) {
+	if len(users) == 0 {
+		return
+	}
+	names := make([]string, len(users))
+	for i, u := range users {
+		names[i] = u.Username
+	}
+
+	resp, err := followStateRedisScript.Run(c.redis, []string{username}, names).Result()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for i, rr := range resp.([]interface{}) {
+		fields := rr.([]interface{})
+		users[i].FollowersCount = fields[0].(int64)
+		users[i].FollowingCount = fields[1].(int64)
+		users[i].IsFollowing = fields[2].(int64) == 1
+	}
+}
+
+//usersByName loads the public side of the users in names, keeping their order
+func (c *appContext) usersByName(names []string) ([]User, error) {
+	found := []User{}
+	err := c.db.C("users").Find(bson.M{
+		"username":  bson.M{"$in": names},
+		"deletedat": bson.M{"$exists": false},
+	}).Select(publicUserFields).All(&found)
+	if err != nil {
+		return nil, err
+	}
+
+	byName := map[string]User{}
+	for _, u := range found {
+		byName[u.Username] = u
+	}
+	users := []User{}
+	for _, n := range names {
+		if u, ok := byName[n]; ok {
+			users = append(users, u)
+		}
+	}
+	return users, nil
+}
+
+//pruneUsernames takes the names in a page of the set at key that usersByName found no
+//account for out of the set, so its size stays the number of users it lists. Deleting an
+//account cleans up the sets it knows about, this catches the rest. It returns how many
+//names went
+func (c *appContext) pruneUsernames(key string, names []string, users []User) int64 {
+	found := map[string]bool{}
+	for _, u := range users {
+		found[u.Username] = true
+	}
+	gone := []string{}
+	for _, n := range names {
+		if !found[n] {
+			gone = append(gone, n)
+		}
+	}
+	if len(gone) == 0 {
+		return 0
+	}
+
+	err := c.redis.SRem(key, gone...).Err()
+	if err != nil {
+		log.Println(err)
+	}
+	return int64(len(gone))
+}
+
+//Handlers
+
+func (c *appContext) followHandler(w http.ResponseWriter, r *http.Request) {
+	params := context.Get(r, "params").(httprouter.Params)
+	followee := params.ByName("username")
+	user, err := userget(r)
+	if err != nil || user.Username == "" {
+		WriteError(w, ErrUnauthorized)
+		return
+	}
+	if followee == user.Username {
+		WriteError(w, ErrFollowSelf)
+		return
+	}
+
+	repo := UserRepo{c.db.C("users")}
+	_, err = repo.Find(followee)
+	if err == mgo.ErrNotFound {
+		WriteError(w, ErrNotFound)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	blocked, err := c.blockedBetween(user.Username, followee)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	if blocked {
+		WriteError(w, ErrBlocked)
+		return
+	}
+
+	err = c.follow(user.Username, followee)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *appContext) unfollowHandler(w http.ResponseWriter, r *http.Request) {
+	params := context.Get(r, "params").(httprouter.Params)
+	user, err := userget(r)
+	if err != nil || user.Username == "" {
+		WriteError(w, ErrUnauthorized)
+		return
+	}
+
+	err = c.unfollow(user.Username, params.ByName("username"))
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//followsHandler lists a page of a user's followers or of who they follow, set says which
+func (c *appContext) followsHandler(set string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := context.Get(r, "params").(httprouter.Params)
+		username := params.ByName("username")
+		viewer, _ := userget(r)
+		page, perPage := pageget(r)
+
+		key := "users:" + username + ":" + set
+		names, total, err := c.usernamePage(key, page, perPage)
+		if err != nil {
+			log.Println(err)
+			WriteError(w, ErrInternalServer)
+			return
+		}
+
+		users, err := c.usersByName(names)
+		if err != nil {
+			log.Println(err)
+			WriteError(w, ErrInternalServer)
+			return
+		}
+		total -= c.pruneUsernames(key, names, users)
+		c.checkFollowedState(users, viewer.Username)
+
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		json.NewEncoder(w).Encode(UsersPage{
+			Data: publicUsers(users),
+			Meta: Page{Page: page, PerPage: perPage, Total: total},
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Skills can carry where they are as a GeoJSON point, and how far their
+// provider is willing to travel. A "near me" search finds the skills within
+// the radius the customer asked for, and also the ones further out whose
+// provider travels as far as the customer. Distances are in km everywhere
+// except inside mongo, which wants metres.
+const (
+	//NearDefaultRadius is how far a near search looks when the client doesn't say, in km
+	NearDefaultRadius = 10
+
+	//NearMaxRadius is the furthest a near search can look, in km
+	NearMaxRadius = 100
+
+	//MaxServiceRadius is the furthest a provider can say they travel, in km
+	MaxServiceRadius = 100
+
+	//NearCandidates is how many skills past the page a near search lets the service
+	//radius filter drop before it stops looking
+	NearCandidates = 1000
+
+	// shown locations are rounded to about a km, so they don't give the address away
+	publicLocationPrecision = 100
+)
+
+//GeoPoint is a GeoJSON point. Coordinates are longitude first, then latitude
+type GeoPoint struct {
+	Type        string    `json:"type" bson:"type"`
+	Coordinates []float64 `json:"coordinates" bson:"coordinates"`
+}
+
+//Utility methods
+
+//NewGeoPoint returns the point at lat, lng
+func NewGeoPoint(lat, lng float64) *GeoPoint {
+	return &GeoPoint{Type: "Point", Coordinates: []float64{lng, lat}}
+}
+
+//validLocation checks where a skill says it is and how far its provider travels
+func validLocation(s *Skill) bool {
+	if s.ServiceRadius < 0 || s.ServiceRadius > MaxServiceRadius {
+		return false
+	}
+	if s.Location == nil {
+		return s.ServiceRadius == 0
+	}
+	p := s.Location
+	return p.Type == "Point" && len(p.Coordinates) == 2 &&
+		p.Coordinates[0] >= -180 && p.Coordinates[0] <= 180 &&
+		p.Coordinates[1] >= -90 && p.Coordinates[1] <= 90
+}
+
+//roundTo rounds x to 1/precision
+func roundTo(x float64, precision float64) float64 {
+	return math.Floor(x*precision+0.5) / precision
+}
+
+//parseNear reads "lat,lng"
+func parseNear(s string) (*GeoPoint, bool) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return nil, false
+	}
+	lat, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return nil, false
+	}
+	lng, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil || lng < -180 || lng > 180 {
+		return nil, false
+	}
+	return NewGeoPoint(lat, lng), true
+}
+
+//searchNear returns a page of the skills matching query that are within radius km of
+//point, or whose provider travels that far, nearest first. more says whether there is
+//another page after this one
+func (c *appContext) searchNear(query bson.M, point *GeoPoint, radius float64, page, perPage int) (skills []Skill, more bool, err error) {
+	metres := radius * 1000
+	pipeline := []bson.M{
+		{"$geoNear": bson.M{
+			"near":          point,
+			"distanceField": "distance",
+			"maxDistance":   math.Max(radius, MaxServiceRadius) * 1000,
+			"spherical":     true,
+			"query":         query,
+			// $geoNear stops at 100 documents unless told otherwise, and
+			// the redact below drops some of what it returns
+			"num": page*perPage + 1 + NearCandidates,
+		}},
+		{"$redact": bson.M{"$cond": bson.M{
+			"if": bson.M{"$or": []bson.M{
+				{"$lte": []interface{}{"$distance", metres}},
+				{"$lte": []interface{}{"$distance", bson.M{"$multiply": []interface{}{
+					bson.M{"$ifNull": []interface{}{"$serviceradius", 0}}, 1000,
+				}}}},
+			}},
+			"then": "$$KEEP",
+			"else": "$$PRUNE",
+		}}},
+		{"$skip": (page - 1) * perPage},
+		{"$limit": perPage + 1},
+	}
+
+	found := []struct {
+		Skill    `bson:",inline"`
+		Distance float64 `bson:"distance"`
+	}{}
+	err = c.db.C("skills").Pipe(pipeline).All(&found)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(found) > perPage {
+		found, more = found[:perPage], true
+	}
+
+	skills = []Skill{}
+	for _, f := range found {
+		// whole km only, finer than that and a few searches from around
+		// the skill would give its exact location away
+		f.Skill.Distance = roundTo(f.Distance/1000, 1)
+		skills = append(skills, f.Skill)
+	}
+	return skills, more, nil
+}
+
+//Handlers
+
+//nearSkillsHandler is the catalog in near mode, ?near=lat,lng&radius=km. It pages by
+//page number rather than by cursor since the order depends on where the customer is
+func (c *appContext) nearSkillsHandler(w http.ResponseWriter, r *http.Request, query bson.M) {
+	v := r.URL.Query()
+	if v.Get("sort") != "" || v.Get("after") != "" || v.Get("before") != "" {
+		WriteError(w, ErrInvalidFilter)
+		return
+	}
+	point, ok := parseNear(v.Get("near"))
+	if !ok {
+		WriteError(w, ErrInvalidLocation)
+		return
+	}
+	radius := float64(NearDefaultRadius)
+	if s := v.Get("radius"); s != "" {
+		var err error
+		radius, err = strconv.ParseFloat(s, 64)
+		if err != nil || radius <= 0 || radius > NearMaxRadius {
+			WriteError(w, ErrInvalidLocation)
+			return
+		}
+	}
+
+	page, perPage := pageget(r)
+	skills, more, err := c.searchNear(query, point, radius, page, perPage)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	result := SkillsPage{Data: skills, Links: Links{Self: r.URL.RequestURI()}}
+	for i := range result.Data {
+		result.Data[i].hideContact()
+	}
+	if more {
+		result.Links.Next = catalogLink(r, "page", strconv.Itoa(page+1))
+	}
+	if page > 1 {
+		result.Links.Prev = catalogLink(r, "page", strconv.Itoa(page-1))
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	json.NewEncoder(w).Encode(result)
+}
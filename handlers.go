@@ -2,75 +2,147 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
 	"log"
 	"net/http"
-	"time"
 
-	"github.com/dgrijalva/jwt-go"
 	"golang.org/x/crypto/bcrypt"
-	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
 // Main handlers
 func (c *appContext) authHandler(w http.ResponseWriter, r *http.Request) {
-	u := User{}
+	// User never reads a password from json, so it comes in next to it
+	body := struct {
+		User
+		Password string `json:"password"`
+	}{}
 	user := &User{}
-	log.Println(r.Body)
-	err := json.NewDecoder(r.Body).Decode(&u)
-	log.Println(u)
+	err := json.NewDecoder(r.Body).Decode(&body)
+	u := body.User
+	u.Password = body.Password
 
 	if u.Provider == "local" {
+		// signing up counts against the same throttle as signing in, or it
+		// would be a free way to find out which emails have accounts
+		ip := clientIP(r)
+		wait, locked, err := c.loginThrottled(u.Email, ip)
+		if err != nil {
+			log.Println(err)
+		}
+		if locked {
+			w.Header().Set("Retry-After", seconds(wait))
+			WriteError(w, ErrAccountLocked)
+			return
+		}
+		if wait > 0 {
+			w.Header().Set("Retry-After", seconds(wait))
+			WriteError(w, ErrTooManyAttempts)
+			return
+		}
+
 		if u.Name != "" {
+			if len(u.Password) < MinPasswordLength {
+				WriteError(w, ErrPasswordTooShort)
+				return
+			}
+			if u.Email == "" {
+				WriteError(w, ErrBadRequest)
+				return
+			}
+
+			C := c.db.C("users")
+			n, err := C.Find(bson.M{"email": u.Email, "provider": "local"}).Count()
+			if err != nil {
+				log.Println(err)
+				WriteError(w, ErrInternalServer)
+				return
+			}
+			if n > 0 {
+				c.loginFailed(u.Email, ip, nil)
+				WriteError(w, ErrEmailTaken)
+				return
+			}
+
 			phash, err := bcrypt.GenerateFromPassword([]byte(u.Password), Cost)
 			if err != nil {
 				log.Println(err)
+				WriteError(w, ErrInternalServer)
+				return
 			}
 
-			C := c.db.C("users")
+			id := bson.NewObjectId()
+			err = C.Insert(bson.M{
+				"_id":      id,
+				"pid":      bson.NewObjectId().Hex(),
+				"provider": "local",
+				"name":     u.Name,
+				"email":    u.Email,
+				"password": phash,
+				"verified": false,
+			})
+			if err != nil {
+				log.Println(err)
+				WriteError(w, ErrInternalServer)
+				return
+			}
 
-			u.PID = bson.NewObjectId().Hex()
-
-			change := mgo.Change{
-				Update: bson.M{
-					"$set": bson.M{
-						"pid":      u.PID,
-						"username": u.Username,
-						"name":     u.Name,
-						"email":    u.Email,
-						"password": phash,
-					},
-				},
-				Upsert:    true,
-				ReturnNew: true,
+			// the identities index is what stops two sign ups racing for one email
+			ids := IdentityRepo{c.db.C("identities")}
+			err = ids.Link(lookUp{Provider: "local", ProviderUID: u.Email, UserID: id.Hex()})
+			if err != nil {
+				C.RemoveId(id)
+				if err == errIdentityTaken {
+					c.loginFailed(u.Email, ip, nil)
+					WriteError(w, ErrEmailTaken)
+					return
+				}
+				log.Println(err)
+				WriteError(w, ErrInternalServer)
+				return
 			}
 
-			_, err = C.Find(bson.M{"email": u.Email, "provider": u.Provider}).Apply(change, &u)
-			//log.Println(info)
+			repo := UserRepo{C}
+			created, err := repo.FindID(id.Hex())
+			if err != nil {
+				log.Println(err)
+				WriteError(w, ErrInternalServer)
+				return
+			}
 
+			err = c.sendVerificationEmail(&created)
 			if err != nil {
 				log.Println(err)
 			}
 
-			user = &u
+			user = c.claimSuggestedUsername(id.Hex(), u.Username, &created)
 
 		} else {
 			xx := c.db.C("users")
 			var res User
-			err := xx.Find(bson.M{
+			err = xx.Find(bson.M{
 				"provider": "local",
 				"email":    u.Email,
 			}).One(&res)
 			if err != nil {
 				log.Println(err)
+				c.loginFailed(u.Email, ip, nil)
+				WriteError(w, ErrInvalidCredentials)
+				return
 			}
 
 			err = bcrypt.CompareHashAndPassword([]byte(res.Password), []byte(u.Password))
 			if err != nil {
 				log.Println("password err")
 				log.Println(err)
+				c.loginFailed(u.Email, ip, &res)
+				WriteError(w, ErrInvalidCredentials)
+				return
+			}
+			// with 2FA on, the failures stay until the code is right too
+			if !res.TOTPEnabled {
+				c.loginSucceeded(u.Email)
 			}
+			c.ensureIdentity(bson.M{"email": u.Email, "provider": "local"}, "local", u.Email)
 			user = &res
 		}
 	} else {
@@ -78,66 +150,52 @@ func (c *appContext) authHandler(w http.ResponseWriter, r *http.Request) {
 
 		if err != nil {
 			log.Println(err)
+			WriteError(w, ErrProviderAuth)
+			return
 		}
 
 	}
 
-	if user.Username == "" {
-		w.Header().Set("Content-Type", "application/vnd.api+json")
-		w.WriteHeader(http.StatusOK)
-
-		response := struct {
-			User    *User  `json:"user"`
-			Message string `json:"message"`
-			Token   string `json:"token"`
-		}{
-			User:    user,
-			Message: "Sign up not yet complete",
-		}
-
-		json.NewEncoder(w).Encode(response)
-
-	} else {
-		// create a signer for rsa 256
-		t := jwt.New(jwt.GetSigningMethod("RS256"))
-
-		// set our claims
-		t.Claims["AccessToken"] = user.Permission
-		t.Claims["User"] = user
+	c.writeSignIn(w, r, user, "SDasd")
+}
 
-		log.Println("the tokened user is", user)
-		// set the expire time
-		// see http://tools.ietf.org/html/draft-ietf-oauth-json-web-token-20#section-4.1.4
-		t.Claims["exp"] = time.Now().Add(time.Minute * 3000).Unix()
-		tokenString, err := t.SignedString(c.signKey)
+//writeSignIn finishes a sign in the same way whichever way the user proved who they
+//are: accounts without a username still have to finish signing up, accounts with 2FA
+//get a challenge and everyone else gets their tokens
+func (c *appContext) writeSignIn(w http.ResponseWriter, r *http.Request, user *User, message string) {
+	if !user.DeletedAt.IsZero() {
+		WriteError(w, ErrAccountDeleted)
 
+	} else if user.Username == "" {
+		// the onboarding token is what lets them claim a username
+		onboarding, err := c.signOnboardingToken(user)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintln(w, "Sorry, error while Signing Token!")
-			log.Printf("Token Signing error: %v\n", err)
+			log.Println(err)
+			WriteError(w, ErrInternalServer)
 			return
 		}
 
-		http.SetCookie(w, &http.Cookie{
-			Name:       c.token,
-			Value:      tokenString,
-			Path:       "/",
-			RawExpires: "0",
-		})
-
 		w.Header().Set("Content-Type", "application/vnd.api+json")
 		w.WriteHeader(http.StatusOK)
 
 		response := struct {
-			User    *User  `json:"user"`
-			Message string `json:"message"`
-			Token   string `json:"token"`
+			User            SelfUser `json:"user"`
+			Message         string   `json:"message"`
+			Token           string   `json:"token"`
+			OnboardingToken string   `json:"onboarding_token"`
 		}{
-			User:    user,
-			Message: "SDasd",
-			Token:   tokenString,
+			User:            selfUser(user),
+			Message:         "Sign up not yet complete",
+			OnboardingToken: onboarding,
 		}
-		//log.Println(response)
+
 		json.NewEncoder(w).Encode(response)
+
+	} else if user.TOTPEnabled {
+		c.writeTwoFactorChallenge(w, user)
+
+	} else {
+		log.Println("the tokened user is", user)
+		c.writeTokenResponse(w, r, user, message)
 	}
 }
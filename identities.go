@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/context"
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	errIdentityTaken    = errors.New("identity belongs to another user")
+	errLastLoginMethod  = errors.New("can't unlink the last way to sign in")
+	errIdentityNotFound = errors.New("identity not linked")
+)
+
+//IdentitiesCollection holds the login methods linked to a user under the key "data"
+type IdentitiesCollection struct {
+	Data []lookUp `json:"data"`
+}
+
+//IdentityRepo wraps the identities collection, one lookUp document for every way
+//a user can sign in
+type IdentityRepo struct {
+	coll *mgo.Collection
+}
+
+//Utility methods
+
+//EnsureIndexes makes sure an identity can only ever point at one user
+func (r *IdentityRepo) EnsureIndexes() error {
+	err := r.coll.EnsureIndex(mgo.Index{
+		Key:    []string{"provider", "provideruid"},
+		Unique: true,
+	})
+	if err != nil {
+		return err
+	}
+	return r.coll.EnsureIndexKey("userid")
+}
+
+//Find returns the identity uid has with provider
+func (r *IdentityRepo) Find(provider, uid string) (lookUp, error) {
+	result := lookUp{}
+	err := r.coll.Find(bson.M{
+		"provider":    provider,
+		"provideruid": uid,
+	}).One(&result)
+	return result, err
+}
+
+//All returns every identity linked to the user with id userID
+func (r *IdentityRepo) All(userID string) ([]lookUp, error) {
+	result := []lookUp{}
+	err := r.coll.Find(bson.M{"userid": userID}).All(&result)
+	return result, err
+}
+
+//Link ties an identity to a user, it fails if the identity is already someone else's
+func (r *IdentityRepo) Link(identity lookUp) error {
+	existing, err := r.Find(identity.Provider, identity.ProviderUID)
+	if err == nil {
+		if existing.UserID != identity.UserID {
+			return errIdentityTaken
+		}
+		return nil
+	}
+	if err != mgo.ErrNotFound {
+		return err
+	}
+
+	err = r.coll.Insert(identity)
+	if mgo.IsDup(err) {
+		return errIdentityTaken
+	}
+	return err
+}
+
+//Unlink removes the identity a user has with provider, as long as they are left with
+//some other way to sign in
+func (r *IdentityRepo) Unlink(userID, provider string) (lookUp, error) {
+	identities, err := r.All(userID)
+	if err != nil {
+		return lookUp{}, err
+	}
+
+	for _, identity := range identities {
+		if identity.Provider != provider {
+			continue
+		}
+		if len(identities) < 2 {
+			return identity, errLastLoginMethod
+		}
+		return identity, r.coll.Remove(bson.M{
+			"provider":    identity.Provider,
+			"provideruid": identity.ProviderUID,
+			"userid":      userID,
+		})
+	}
+
+	return lookUp{}, errIdentityNotFound
+}
+
+//userID returns the mongo id of the user matching query
+func (r *UserRepo) userID(query bson.M) (string, error) {
+	var result struct {
+		ID bson.ObjectId `bson:"_id"`
+	}
+	err := r.coll.Find(query).Select(bson.M{"_id": 1}).One(&result)
+	if err != nil {
+		return "", err
+	}
+	return result.ID.Hex(), nil
+}
+
+//FindID returns the user with the mongo id id
+func (r *UserRepo) FindID(id string) (User, error) {
+	result := User{}
+	if !bson.IsObjectIdHex(id) {
+		return result, mgo.ErrNotFound
+	}
+	err := r.coll.FindId(bson.ObjectIdHex(id)).One(&result)
+	return result, err
+}
+
+//linkedUser returns the user identity is linked to, if any
+func (c *appContext) linkedUser(identity *ProviderIdentity) (*User, error) {
+	ids := IdentityRepo{c.db.C("identities")}
+	link, err := ids.Find(identity.Provider, identity.PID)
+	if err != nil {
+		return nil, err
+	}
+
+	repo := UserRepo{c.db.C("users")}
+	user, err := repo.FindID(link.UserID)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+//linkByEmail ties identity to the existing account with the same email. Both sides need
+//to have verified the address, otherwise anyone could sign up with someone else's email
+//and wait for them to log in with a provider. Accounts that unlinked the provider have
+//to link it again by hand
+func (c *appContext) linkByEmail(identity *ProviderIdentity) (*User, error) {
+	if identity.Email == "" || !identity.EmailVerified {
+		return nil, mgo.ErrNotFound
+	}
+
+	repo := UserRepo{c.db.C("users")}
+	query := bson.M{"email": identity.Email, "verified": true, "unlinked": bson.M{"$ne": identity.Provider}}
+	id, err := repo.userID(query)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := IdentityRepo{c.db.C("identities")}
+	err = ids.Link(lookUp{
+		Provider:    identity.Provider,
+		ProviderUID: identity.PID,
+		UserID:      id,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := repo.FindID(id)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("linked %s identity to %s by email\n", identity.Provider, user.Username)
+	return &user, nil
+}
+
+//ensureIdentity records the login method a user document was created with, for users
+//that predate the identities collection
+func (c *appContext) ensureIdentity(query bson.M, provider, uid string) {
+	repo := UserRepo{c.db.C("users")}
+	id, err := repo.userID(query)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	ids := IdentityRepo{c.db.C("identities")}
+	err = ids.Link(lookUp{Provider: provider, ProviderUID: uid, UserID: id})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+//Handlers
+
+func (c *appContext) identitiesHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := userget(r)
+	if err != nil || user.Username == "" {
+		WriteError(w, ErrUnauthorized)
+		return
+	}
+
+	repo := UserRepo{c.db.C("users")}
+	id, err := repo.userID(bson.M{"username": user.Username})
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrUnauthorized)
+		return
+	}
+
+	ids := IdentityRepo{c.db.C("identities")}
+	identities, err := ids.All(id)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	json.NewEncoder(w).Encode(IdentitiesCollection{identities})
+}
+
+func (c *appContext) linkIdentityHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := userget(r)
+	if err != nil || user.Username == "" {
+		WriteError(w, ErrUnauthorized)
+		return
+	}
+	body := context.Get(r, "body").(*User)
+
+	verifier, ok := c.verifiers[body.Provider]
+	if !ok {
+		WriteError(w, ErrProviderAuth)
+		return
+	}
+	identity, err := verifier.Verify(body.IDToken)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrProviderAuth)
+		return
+	}
+
+	repo := UserRepo{c.db.C("users")}
+	id, err := repo.userID(bson.M{"username": user.Username})
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrUnauthorized)
+		return
+	}
+
+	link := lookUp{
+		Provider:    identity.Provider,
+		ProviderUID: identity.PID,
+		UserID:      id,
+	}
+	ids := IdentityRepo{c.db.C("identities")}
+	err = ids.Link(link)
+	if err == errIdentityTaken {
+		WriteError(w, ErrIdentityTaken)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	err = c.db.C("users").UpdateId(bson.ObjectIdHex(id), bson.M{"$pull": bson.M{"unlinked": identity.Provider}})
+	if err != nil {
+		log.Println(err)
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		Data lookUp `json:"data"`
+	}{link})
+}
+
+func (c *appContext) unlinkIdentityHandler(w http.ResponseWriter, r *http.Request) {
+	params := context.Get(r, "params").(httprouter.Params)
+	user, err := userget(r)
+	if err != nil || user.Username == "" {
+		WriteError(w, ErrUnauthorized)
+		return
+	}
+
+	repo := UserRepo{c.db.C("users")}
+	id, err := repo.userID(bson.M{"username": user.Username})
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrUnauthorized)
+		return
+	}
+
+	ids := IdentityRepo{c.db.C("identities")}
+	identity, err := ids.Unlink(id, params.ByName("provider"))
+	switch err {
+	case nil:
+	case errIdentityNotFound:
+		WriteError(w, ErrNotFound)
+		return
+	case errLastLoginMethod:
+		WriteError(w, ErrLastLoginMethod)
+		return
+	default:
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	// linking by email would bring the provider straight back on its next
+	// sign in, so the account remembers it doesn't want it
+	err = c.db.C("users").UpdateId(bson.ObjectIdHex(id), bson.M{"$addToSet": bson.M{"unlinked": identity.Provider}})
+	if err != nil {
+		log.Println(err)
+	}
+
+	// the user document remembers the method it was created with, and
+	// would let it sign in again if we left it there
+	unset := bson.M{}
+	switch {
+	case identity.Provider == "local":
+		unset["password"] = ""
+	default:
+		unset["pid"] = ""
+	}
+	err = c.db.C("users").Update(bson.M{
+		"_id":      bson.ObjectIdHex(id),
+		"provider": identity.Provider,
+	}, bson.M{"$unset": unset})
+	if err != nil && err != mgo.ErrNotFound {
+		log.Println(err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
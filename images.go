@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/context"
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Uploaded images are never stored as they come in. They are decoded, turned
+// the right way up, scaled down and encoded again, which also drops any
+// EXIF data (like where the photo was taken) the original carried.
+const (
+	//MaxImageSize is the biggest upload accepted, in bytes
+	MaxImageSize = 10 << 20
+
+	//MaxImagePixels is the most pixels an upload can decode to, so a small file
+	//can't blow up into a huge image in memory
+	MaxImagePixels = 25000000
+
+	//FullImageSize is the longest side of the full size copy
+	FullImageSize = 1600
+
+	//ThumbImageSize is the longest side of the thumbnail
+	ThumbImageSize = 320
+
+	//MaxSkillImages is how many images a skill can have
+	MaxSkillImages = 10
+
+	jpegQuality = 85
+)
+
+//ImageResource carries a single image under the key "data"
+type ImageResource struct {
+	Data Images `json:"data"`
+}
+
+//Utility methods
+
+//readUpload reads the image in the multipart field "image" of r
+func readUpload(w http.ResponseWriter, r *http.Request) ([]byte, *Error) {
+	// room for the multipart framing around the file
+	r.Body = http.MaxBytesReader(w, r.Body, MaxImageSize+1<<20)
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(file, MaxImageSize+1))
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+	if len(data) > MaxImageSize {
+		return nil, ErrImageTooLarge
+	}
+	return data, nil
+}
+
+//exifOrientation returns the EXIF orientation of a jpeg, 1 (as is) when it has none
+func exifOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		// metadata all comes before the image data starts
+		if marker == 0xDA || marker == 0xD9 {
+			return 1
+		}
+		size := int(binary.BigEndian.Uint16(data[i+2:]))
+		if size < 2 || i+2+size > len(data) {
+			return 1
+		}
+		segment := data[i+4 : i+2+size]
+		if marker == 0xE1 && len(segment) > 6 && string(segment[:6]) == "Exif\x00\x00" {
+			return tiffOrientation(segment[6:])
+		}
+		i += 2 + size
+	}
+	return 1
+}
+
+//tiffOrientation finds the orientation tag in the first IFD of the tiff structure in t
+func tiffOrientation(t []byte) int {
+	if len(t) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(t[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(t[4:]))
+	if ifd < 0 || ifd+2 > len(t) {
+		return 1
+	}
+	entries := int(order.Uint16(t[ifd:]))
+	for e := 0; e < entries; e++ {
+		off := ifd + 2 + e*12
+		if off+12 > len(t) {
+			return 1
+		}
+		if order.Uint16(t[off:]) == 0x0112 {
+			o := int(order.Uint16(t[off+8:]))
+			if o < 1 || o > 8 {
+				return 1
+			}
+			return o
+		}
+	}
+	return 1
+}
+
+//orient turns src the way EXIF orientation o says it should be shown
+func orient(src image.Image, o int) image.Image {
+	if o <= 1 || o > 8 {
+		return src
+	}
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if o >= 5 {
+		dw, dh = h, w
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch o {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			dst.Set(x, y, src.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	return dst
+}
+
+//fit scales src down so its longest side is at most max, averaging the pixels that
+//end up in each one. Images that already fit are left alone
+func fit(src image.Image, max int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= max && h <= max {
+		return src
+	}
+	dw, dh := max, h*max/w
+	if h > w {
+		dw, dh = w*max/h, max
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		sy0, sy1 := y*h/dh, (y+1)*h/dh
+		for x := 0; x < dw; x++ {
+			sx0, sx1 := x*w/dw, (x+1)*w/dw
+			var r, g, bl, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					cr, cg, cb, ca := src.At(b.Min.X+sx, b.Min.Y+sy).RGBA()
+					r, g, bl, a, n = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			if a == 0 {
+				continue
+			}
+			// RGBA() is premultiplied, NRGBA isn't
+			dst.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(r * 0xff / a),
+				G: uint8(g * 0xff / a),
+				B: uint8(bl * 0xff / a),
+				A: uint8(a / n >> 8),
+			})
+		}
+	}
+	return dst
+}
+
+//encodeImage encodes img in format, which is either "png" or "jpeg"
+func encodeImage(img image.Image, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	if format == "png" {
+		err = png.Encode(&buf, img)
+	} else {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality})
+	}
+	return buf.Bytes(), err
+}
+
+//storeImage checks an upload, makes its full size copy and thumbnail and stores both
+//under prefix
+func (c *appContext) storeImage(data []byte, prefix string) (*Images, *Error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || (format != "jpeg" && format != "png") {
+		return nil, ErrInvalidImage
+	}
+	if config.Width*config.Height > MaxImagePixels {
+		return nil, ErrInvalidImage
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+
+	o := 1
+	if format == "jpeg" {
+		o = exifOrientation(data)
+	}
+	full := fit(src, FullImageSize)
+	thumb := fit(full, ThumbImageSize)
+
+	contentType, ext := "image/jpeg", ".jpg"
+	if format == "png" {
+		contentType, ext = "image/png", ".png"
+	}
+	id := bson.NewObjectId().Hex()
+	img := &Images{
+		ID:       id,
+		FullKey:  prefix + "/" + id + ext,
+		ThumbKey: prefix + "/" + id + "-thumb" + ext,
+	}
+
+	fullData, err := encodeImage(orient(full, o), format)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternalServer
+	}
+	thumbData, err := encodeImage(orient(thumb, o), format)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternalServer
+	}
+
+	err = c.blobs.Put(img.FullKey, fullData, contentType)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternalServer
+	}
+	err = c.blobs.Put(img.ThumbKey, thumbData, contentType)
+	if err != nil {
+		log.Println(err)
+		c.deleteImages(*img)
+		return nil, ErrInternalServer
+	}
+
+	img.Full = c.blobs.URL(img.FullKey)
+	img.Thumb = c.blobs.URL(img.ThumbKey)
+	return img, nil
+}
+
+//deleteImages removes the stored copies of images. Images that were only ever urls
+//from the client have nothing stored
+func (c *appContext) deleteImages(images ...Images) {
+	for _, img := range images {
+		for _, key := range []string{img.FullKey, img.ThumbKey} {
+			if key == "" {
+				continue
+			}
+			if err := c.blobs.Delete(key); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+//AddImage adds img to the skill with id, unless it already has as many as it can
+func (r *SkillRepo) AddImage(id bson.ObjectId, img *Images) error {
+	skill := Skill{}
+	_, err := r.coll.Find(bson.M{
+		"_id": id,
+		// there is no room once the last allowed slot is taken
+		"images." + strconv.Itoa(MaxSkillImages-1): bson.M{"$exists": false},
+	}).Apply(mgo.Change{
+		Update:    bson.M{"$push": bson.M{"images": img}},
+		ReturnNew: true,
+	}, &skill)
+	if err != nil {
+		return err
+	}
+	r.index(&skill)
+	return nil
+}
+
+//RemoveImage takes the image with imageID off the skill with id, and returns it
+func (r *SkillRepo) RemoveImage(id bson.ObjectId, imageID string) (*Images, error) {
+	skill := Skill{}
+	_, err := r.coll.Find(bson.M{"_id": id, "images.id": imageID}).Apply(mgo.Change{
+		Update: bson.M{"$pull": bson.M{"images": bson.M{"id": imageID}}},
+	}, &skill)
+	if err != nil {
+		return nil, err
+	}
+
+	var removed *Images
+	kept := []Images{}
+	for i := range skill.Images {
+		if skill.Images[i].ID == imageID {
+			removed = &skill.Images[i]
+		} else {
+			kept = append(kept, skill.Images[i])
+		}
+	}
+	skill.Images = kept
+	r.index(&skill)
+	return removed, nil
+}
+
+//Handlers
+
+func (c *appContext) uploadSkillImageHandler(w http.ResponseWriter, r *http.Request) {
+	params := context.Get(r, "params").(httprouter.Params)
+	skill, ok := c.ownedSkill(w, r, params.ByName("slug"))
+	if !ok {
+		return
+	}
+	if len(skill.Images) >= MaxSkillImages {
+		WriteError(w, ErrTooManyImages)
+		return
+	}
+
+	data, e := readUpload(w, r)
+	if e != nil {
+		WriteError(w, e)
+		return
+	}
+	img, e := c.storeImage(data, "skills/"+skill.ID.Hex())
+	if e != nil {
+		WriteError(w, e)
+		return
+	}
+
+	repo := SkillRepo{c.db.C("skills"), c.search}
+	err := repo.AddImage(skill.ID, img)
+	if err != nil {
+		c.deleteImages(*img)
+		if err == mgo.ErrNotFound {
+			WriteError(w, ErrTooManyImages)
+			return
+		}
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(ImageResource{*img})
+}
+
+func (c *appContext) deleteSkillImageHandler(w http.ResponseWriter, r *http.Request) {
+	params := context.Get(r, "params").(httprouter.Params)
+	skill, ok := c.ownedSkill(w, r, params.ByName("slug"))
+	if !ok {
+		return
+	}
+
+	repo := SkillRepo{c.db.C("skills"), c.search}
+	img, err := repo.RemoveImage(skill.ID, params.ByName("id"))
+	if err == mgo.ErrNotFound {
+		WriteError(w, ErrNotFound)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	c.deleteImages(*img)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//uploadAvatarHandler sets the user's picture, replacing the one they had
+func (c *appContext) uploadAvatarHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := c.currentUser(r)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrUnauthorized)
+		return
+	}
+
+	data, e := readUpload(w, r)
+	if e != nil {
+		WriteError(w, e)
+		return
+	}
+	img, e := c.storeImage(data, "avatars")
+	if e != nil {
+		WriteError(w, e)
+		return
+	}
+
+	err = c.db.C("users").Update(bson.M{"username": user.Username}, bson.M{
+		"$set": bson.M{"image": img.Full, "avatar": img},
+	})
+	if err != nil {
+		log.Println(err)
+		c.deleteImages(*img)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	if user.Avatar != nil {
+		c.deleteImages(*user.Avatar)
+	}
+
+	user.Image, user.Avatar = img.Full, img
+	users := []User{*user}
+	c.checkFollowedState(users, "")
+	writeUser(w, r, &users[0])
+}
+
+//deleteAvatarHandler takes the user's picture down
+func (c *appContext) deleteAvatarHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := c.currentUser(r)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrUnauthorized)
+		return
+	}
+
+	err = c.db.C("users").Update(bson.M{"username": user.Username}, bson.M{
+		"$set":   bson.M{"image": ""},
+		"$unset": bson.M{"avatar": ""},
+	})
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	if user.Avatar != nil {
+		c.deleteImages(*user.Avatar)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
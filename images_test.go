@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// jpegWithOrientation is the start of a jpeg with an exif segment holding just the
+// orientation tag
+func jpegWithOrientation(order binary.ByteOrder, o uint16) []byte {
+	tiff := make([]byte, 8+2+12)
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+	order.PutUint16(tiff[8:], 1)
+	order.PutUint16(tiff[10:], 0x0112)
+	order.PutUint16(tiff[12:], 3)
+	order.PutUint32(tiff[14:], 1)
+	order.PutUint16(tiff[18:], o)
+
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	data := []byte{0xFF, 0xD8, 0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(data[4:], uint16(len(segment)+2))
+	data = append(data, segment...)
+	return append(data, 0xFF, 0xDA, 0, 2)
+}
+
+func TestExifOrientation(t *testing.T) {
+	app0 := []byte{0xFF, 0xD8, 0xFF, 0xE0, 0, 4, 0, 0}
+	tests := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"little endian", jpegWithOrientation(binary.LittleEndian, 6), 6},
+		{"big endian", jpegWithOrientation(binary.BigEndian, 8), 8},
+		{"after app0", append(app0, jpegWithOrientation(binary.BigEndian, 3)[2:]...), 3},
+		{"out of range", jpegWithOrientation(binary.LittleEndian, 9), 1},
+		{"truncated", jpegWithOrientation(binary.LittleEndian, 6)[:20], 1},
+		{"no exif", []byte{0xFF, 0xD8, 0xFF, 0xDA, 0, 2}, 1},
+		{"png", []byte("\x89PNG\r\n\x1a\n"), 1},
+		{"empty", nil, 1},
+	}
+	for _, tt := range tests {
+		if got := exifOrientation(tt.data); got != tt.want {
+			t.Errorf("%s: exifOrientation = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestOrient(t *testing.T) {
+	red := color.NRGBA{0xff, 0, 0, 0xff}
+	blue := color.NRGBA{0, 0, 0xff, 0xff}
+	// 3 wide, 2 tall, red in the top left corner
+	src := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 3; x++ {
+			src.SetNRGBA(x, y, blue)
+		}
+	}
+	src.SetNRGBA(0, 0, red)
+
+	tests := []struct {
+		o          int
+		w, h, x, y int
+	}{
+		{1, 3, 2, 0, 0},
+		{2, 3, 2, 2, 0},
+		{3, 3, 2, 2, 1},
+		{4, 3, 2, 0, 1},
+		{5, 2, 3, 0, 0},
+		{6, 2, 3, 1, 0},
+		{7, 2, 3, 1, 2},
+		{8, 2, 3, 0, 2},
+		{9, 3, 2, 0, 0},
+	}
+	for _, tt := range tests {
+		got := orient(src, tt.o)
+		b := got.Bounds()
+		if b.Dx() != tt.w || b.Dy() != tt.h {
+			t.Errorf("orient(%d) is %dx%d, want %dx%d", tt.o, b.Dx(), b.Dy(), tt.w, tt.h)
+			continue
+		}
+		if c := color.NRGBAModel.Convert(got.At(tt.x, tt.y)); c != red {
+			t.Errorf("orient(%d) at %d,%d = %v, want red", tt.o, tt.x, tt.y, c)
+		}
+	}
+}
+
+func TestFit(t *testing.T) {
+	tests := []struct {
+		w, h, max int
+		dw, dh    int
+	}{
+		{50, 50, 100, 50, 50},
+		{100, 40, 100, 100, 40},
+		{400, 200, 100, 100, 50},
+		{200, 400, 100, 50, 100},
+		{1000, 1, 100, 100, 1},
+	}
+	for _, tt := range tests {
+		b := fit(image.NewNRGBA(image.Rect(0, 0, tt.w, tt.h)), tt.max).Bounds()
+		if b.Dx() != tt.dw || b.Dy() != tt.dh {
+			t.Errorf("fit(%dx%d, %d) is %dx%d, want %dx%d", tt.w, tt.h, tt.max, b.Dx(), b.Dy(), tt.dw, tt.dh)
+		}
+	}
+
+	// black and white average out to grey
+	src := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	src.SetNRGBA(0, 0, color.NRGBA{0, 0, 0, 0xff})
+	src.SetNRGBA(1, 0, color.NRGBA{0xff, 0xff, 0xff, 0xff})
+	want := color.NRGBA{0x7f, 0x7f, 0x7f, 0xff}
+	if c := fit(src, 1).(*image.NRGBA).NRGBAAt(0, 0); c != want {
+		t.Errorf("fit averaged to %v, want %v", c, want)
+	}
+}
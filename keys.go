@@ -0,0 +1,370 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Signing keys live in a directory, one <kid>.rsa / <kid>.rsa.pub pair per
+// key, and a file called "active" holding the kid tokens get signed with.
+// Every key with a public half in there is still trusted, which is what lets
+// tokens signed before a rotation keep working until they expire.
+//
+// Without a keys directory we fall back to the app.rsa pair, under the kid
+// "app". Tokens issued before key ids existed have none and map to it too,
+// which is why the first "keys generate" copies the pair into the new ring.
+const (
+	legacyKeyID   = "app"
+	activeKeyFile = "active"
+)
+
+var errNoSigningKey = errors.New("no active signing key")
+
+type signingKey struct {
+	ID      string
+	Private *rsa.PrivateKey
+	Public  *rsa.PublicKey
+}
+
+//KeyRing holds the key we sign tokens with and every key we still accept tokens from
+type KeyRing struct {
+	dir string
+
+	mu     sync.RWMutex
+	active string
+	keys   map[string]*signingKey
+}
+
+//keysDir returns where the signing keys are kept
+func keysDir() string {
+	dir := os.Getenv("KEYSDIR")
+	if dir == "" {
+		dir = "keys"
+	}
+	return dir
+}
+
+//loadKeyRing reads the keys in dir
+func loadKeyRing(dir string) (*KeyRing, error) {
+	k := &KeyRing{dir: dir}
+	return k, k.Reload()
+}
+
+//Reload rereads the keys directory, so a promotion can be picked up without a restart
+func (k *KeyRing) Reload() error {
+	keys := map[string]*signingKey{}
+	var active string
+
+	if _, err := os.Stat(k.dir); os.IsNotExist(err) {
+		key, err := readKeyPair("app.rsa", "app.rsa.pub", legacyKeyID)
+		if err != nil {
+			return err
+		}
+		keys[legacyKeyID] = key
+		active = legacyKeyID
+	} else {
+		pubs, err := filepath.Glob(filepath.Join(k.dir, "*.rsa.pub"))
+		if err != nil {
+			return err
+		}
+		for _, pub := range pubs {
+			kid := strings.TrimSuffix(filepath.Base(pub), ".rsa.pub")
+			key, err := readKeyPair(strings.TrimSuffix(pub, ".pub"), pub, kid)
+			if err != nil {
+				return err
+			}
+			keys[kid] = key
+		}
+
+		b, err := ioutil.ReadFile(filepath.Join(k.dir, activeKeyFile))
+		if err != nil {
+			return err
+		}
+		active = strings.TrimSpace(string(b))
+	}
+
+	if key, ok := keys[active]; !ok || key.Private == nil {
+		return errNoSigningKey
+	}
+
+	k.mu.Lock()
+	k.keys = keys
+	k.active = active
+	k.mu.Unlock()
+
+	log.Printf("signing with key %s, %d keys trusted\n", active, len(keys))
+	return nil
+}
+
+//readKeyPair reads a key, the private half is optional since retired keys only verify
+func readKeyPair(private, public, kid string) (*signingKey, error) {
+	b, err := ioutil.ReadFile(public)
+	if err != nil {
+		return nil, err
+	}
+	key := &signingKey{ID: kid}
+	key.Public, err = jwt.ParseRSAPublicKeyFromPEM(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", public, err)
+	}
+
+	b, err = ioutil.ReadFile(private)
+	if os.IsNotExist(err) {
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	key.Private, err = jwt.ParseRSAPrivateKeyFromPEM(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", private, err)
+	}
+	return key, nil
+}
+
+//Signer returns the key new tokens get signed with
+func (k *KeyRing) Signer() *signingKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.keys[k.active]
+}
+
+//Public returns the public key with id kid, if we still trust it
+func (k *KeyRing) Public(kid string) (*rsa.PublicKey, error) {
+	if kid == "" {
+		kid = legacyKeyID
+	}
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, errUnknownKey
+	}
+	return key.Public, nil
+}
+
+//JWKS returns every trusted key, for other services to verify our tokens with
+func (k *KeyRing) JWKS() jsonWebKeySet {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	set := jsonWebKeySet{Keys: []jsonWebKey{}}
+	for kid, key := range k.keys {
+		set.Keys = append(set.Keys, jsonWebKey{
+			Kty: "RSA",
+			Kid: kid,
+			Use: "sig",
+			Alg: "RS256",
+			N:   base64.RawURLEncoding.EncodeToString(key.Public.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.Public.E)).Bytes()),
+		})
+	}
+	sort.Sort(byKeyID(set.Keys))
+	return set
+}
+
+type byKeyID []jsonWebKey
+
+func (s byKeyID) Len() int           { return len(s) }
+func (s byKeyID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byKeyID) Less(i, j int) bool { return s[i].Kid < s[j].Kid }
+
+//Command
+
+// keysCommand is run with "keys <command>" instead of starting the server:
+//
+//	keys list            show the keys and which one is active
+//	keys generate        make a new key pair, trusted but not yet used to sign
+//	keys promote <kid>   start signing with kid
+//	keys retire <kid>    stop trusting kid, once no token it signed is still alive
+//
+// a running server picks the change up on SIGHUP. a new key should be
+// generated and deployed everywhere before it is promoted, and an old key
+// should only be retired once the longest lived token it signed has expired.
+func keysCommand(args []string) error {
+	dir := keysDir()
+	if len(args) == 0 {
+		return errors.New("usage: keys list|generate|promote <kid>|retire <kid>")
+	}
+
+	switch args[0] {
+	case "list":
+		b, _ := ioutil.ReadFile(filepath.Join(dir, activeKeyFile))
+		active := strings.TrimSpace(string(b))
+		pubs, err := filepath.Glob(filepath.Join(dir, "*.rsa.pub"))
+		if err != nil {
+			return err
+		}
+		for _, pub := range pubs {
+			kid := strings.TrimSuffix(filepath.Base(pub), ".rsa.pub")
+			state := "trusted"
+			if _, err := os.Stat(strings.TrimSuffix(pub, ".pub")); os.IsNotExist(err) {
+				state = "verify only"
+			}
+			if kid == active {
+				state = "active"
+			}
+			fmt.Println(kid, state)
+		}
+		return nil
+
+	case "generate":
+		_, err := os.Stat(dir)
+		fresh := os.IsNotExist(err)
+		err = os.MkdirAll(dir, 0700)
+		if err != nil {
+			return err
+		}
+
+		// a brand new ring takes over from app.rsa, which keeps signing
+		// until a new key is promoted, and is trusted until it is retired
+		if fresh {
+			signs, err := importLegacyKey(dir)
+			if err != nil {
+				return err
+			}
+			if signs {
+				err = ioutil.WriteFile(filepath.Join(dir, activeKeyFile), []byte(legacyKeyID+"\n"), 0600)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		kid := time.Now().UTC().Format("20060102150405")
+		err = generateKeyPair(dir, kid)
+		if err != nil {
+			return err
+		}
+
+		// a brand new ring has nothing to sign with yet
+		if _, err := os.Stat(filepath.Join(dir, activeKeyFile)); os.IsNotExist(err) {
+			err = ioutil.WriteFile(filepath.Join(dir, activeKeyFile), []byte(kid+"\n"), 0600)
+			if err != nil {
+				return err
+			}
+		}
+		fmt.Println(kid)
+		return nil
+
+	case "promote":
+		if len(args) < 2 {
+			return errors.New("usage: keys promote <kid>")
+		}
+		key, err := readKeyPair(filepath.Join(dir, args[1]+".rsa"), filepath.Join(dir, args[1]+".rsa.pub"), args[1])
+		if err != nil {
+			return err
+		}
+		if key.Private == nil {
+			return errors.New("can't sign with " + args[1] + ", its private key is gone")
+		}
+		return ioutil.WriteFile(filepath.Join(dir, activeKeyFile), []byte(args[1]+"\n"), 0600)
+
+	case "retire":
+		if len(args) < 2 {
+			return errors.New("usage: keys retire <kid>")
+		}
+		b, _ := ioutil.ReadFile(filepath.Join(dir, activeKeyFile))
+		if strings.TrimSpace(string(b)) == args[1] {
+			return errors.New("can't retire the active key, promote another one first")
+		}
+		os.Remove(filepath.Join(dir, args[1]+".rsa"))
+		return os.Remove(filepath.Join(dir, args[1]+".rsa.pub"))
+	}
+
+	return fmt.Errorf("unknown keys command %q", args[0])
+}
+
+//importLegacyKey copies the app.rsa pair into dir under the kid "app". It reports whether
+//the private half was there too, without it the key can only verify
+func importLegacyKey(dir string) (bool, error) {
+	public, err := ioutil.ReadFile("app.rsa.pub")
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, legacyKeyID+".rsa.pub"), public, 0644)
+	if err != nil {
+		return false, err
+	}
+
+	private, err := ioutil.ReadFile("app.rsa")
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, ioutil.WriteFile(filepath.Join(dir, legacyKeyID+".rsa"), private, 0600)
+}
+
+func generateKeyPair(dir, kid string) error {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+
+	private := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return err
+	}
+	public := pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: pub,
+	})
+
+	err = ioutil.WriteFile(filepath.Join(dir, kid+".rsa"), private, 0600)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, kid+".rsa.pub"), public, 0644)
+}
+
+//Handlers
+
+func (c *appContext) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(c.keys.JWKS())
+}
+
+//reloadOnHangup rereads the keys whenever the process gets a SIGHUP
+func reloadOnHangup(k *KeyRing) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			err := k.Reload()
+			if err != nil {
+				log.Println("keeping the old keys:", err)
+			}
+		}
+	}()
+}
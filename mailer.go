@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Mailer is anything that can get an email to a user. Production uses SMTP,
+//local development and tests use a FileMailer so nothing leaves the machine
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+//FileMailer appends every email it is asked to send to a file, or to the log
+//when Path is empty
+type FileMailer struct {
+	Path string
+	mu   sync.Mutex
+}
+
+//Send writes the email out instead of sending it
+func (m *FileMailer) Send(to, subject, body string) error {
+	msg := fmt.Sprintf("Date: %s\nTo: %s\nSubject: %s\n\n%s\n\n", time.Now().Format(time.RFC1123Z), to, subject, body)
+	if m.Path == "" {
+		log.Print(msg)
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := os.OpenFile(m.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(msg)
+	return err
+}
+
+//SMTPMailer sends emails through an smtp server
+type SMTPMailer struct {
+	Addr string
+	From string
+	Auth smtp.Auth
+}
+
+//Send sends a plain text email
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	msg := "From: " + m.From + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n\r\n" +
+		body
+	return smtp.SendMail(m.Addr, m.Auth, m.From, []string{to}, []byte(msg))
+}
+
+//mailerFromEnv picks a mailer based on the environment, SMTPADDR turns on smtp
+//and anything else falls back to writing mails to MAILFILE (or the log)
+func mailerFromEnv() Mailer {
+	addr := os.Getenv("SMTPADDR")
+	if addr == "" {
+		log.Println("No SMTPADDR set, emails would be written to MAILFILE or the log")
+		return &FileMailer{Path: os.Getenv("MAILFILE")}
+	}
+
+	from := os.Getenv("MAILFROM")
+	if from == "" {
+		from = "no-reply@oddjobz.com"
+	}
+
+	var auth smtp.Auth
+	if user := os.Getenv("SMTPUSER"); user != "" {
+		auth = smtp.PlainAuth("", user, os.Getenv("SMTPPW"), strings.Split(addr, ":")[0])
+	}
+
+	return &SMTPMailer{Addr: addr, From: from, Auth: auth}
+}
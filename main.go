@@ -1,7 +1,6 @@
 package main
 
 import (
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
@@ -16,15 +15,21 @@ import (
 )
 
 type appContext struct {
-	db        *mgo.Database
-	verifyKey []byte
-	signKey   []byte
-	token     string
+	db    *mgo.Database
+	keys  *KeyRing
+	token string
 
-	domain string
+	domain   string
+	resetURL string
 
-	bucket *s3.Bucket
+	blobs  BlobStore
 	redis  *redis.Client
+	mailer Mailer
+	sms    SMSSender
+	search Searcher
+
+	verifiers       map[string]ProviderVerifier
+	lockoutNotifier LockoutNotifier
 }
 
 const (
@@ -60,6 +65,11 @@ func (r *Router) Delete(path string, handler http.Handler) {
 	r.DELETE(path, wrapHandler(handler))
 }
 
+// Patch is an endpoint to only accept requests of method PATCH
+func (r *Router) Patch(path string, handler http.Handler) {
+	r.PATCH(path, wrapHandler(handler))
+}
+
 // NewRouter is a wrapper that makes the httprouter struct a child of the router struct
 func NewRouter() *Router {
 	return &Router{httprouter.New()}
@@ -72,7 +82,7 @@ func wrapHandler(h http.Handler) httprouter.Handle {
 	}
 }
 
-func checks() (REDISADDR, REDISPW, MONGOSERVER, MONGODB string, Public []byte, Private []byte, RootURL, AWSBucket string) {
+func checks() (REDISADDR, REDISPW, MONGOSERVER, MONGODB string, RootURL, AWSBucket string) {
 	REDISADDR = os.Getenv("REDISURL")
 
 	REDISPW = os.Getenv("REDISPW")
@@ -105,18 +115,6 @@ func checks() (REDISADDR, REDISPW, MONGOSERVER, MONGODB string, Public []byte, P
 	}
 	log.Println("AWSBucket is ", AWSBucket)
 
-	Public, err := ioutil.ReadFile("app.rsa.pub")
-	if err != nil {
-		log.Fatal("Error reading public key")
-		return
-	}
-
-	Private, err = ioutil.ReadFile("app.rsa")
-	if err != nil {
-		log.Fatal("Error reading private key")
-		return
-	}
-
 	RootURL = os.Getenv("RootURL")
 	if RootURL == "" {
 		RootURL = "http://localhost:8080"
@@ -130,7 +128,21 @@ func init() {
 }
 
 func main() {
-	REDISADDR, REDISPW, MONGOSERVER, MONGODB, Public, Private, RootURL, AWSBucket := checks()
+	if len(os.Args) > 1 && os.Args[1] == "keys" {
+		err := keysCommand(os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	REDISADDR, REDISPW, MONGOSERVER, MONGODB, RootURL, AWSBucket := checks()
+	keys, err := loadKeyRing(keysDir())
+	if err != nil {
+		log.Fatal("Error reading signing keys: ", err)
+	}
+	reloadOnHangup(keys)
+
 	session, err := mgo.Dial(MONGOSERVER)
 	if err != nil {
 		panic(err)
@@ -156,38 +168,156 @@ func main() {
 		panic(err)
 
 	}
+	mailer := mailerFromEnv()
 	appC := appContext{
 		db:        session.DB(MONGODB),
-		verifyKey: []byte(Public),
-		signKey:   []byte(Private),
+		keys:      keys,
 		token:     "AccessToken",
 		domain:    RootURL,
-		bucket:    s3bucket,
+		resetURL:  resetURLFromEnv(RootURL),
+		blobs:     blobStoreFromEnv(s3bucket, RootURL),
 		redis:     rediscli,
+		mailer:    mailer,
+		sms:       smsSenderFromEnv(),
+		search:    searcherFromEnv(session.DB(MONGODB)),
+		verifiers: verifiersFromEnv(),
+
+		lockoutNotifier: &mailLockoutNotifier{mailer},
+	}
+	users := UserRepo{appC.db.C("users")}
+	err = users.EnsureIndexes()
+	if err != nil {
+		// without the unique index two users could share a username
+		log.Fatal("Error indexing usernames, remove duplicate usernames and restart: ", err)
+	}
+	err = appC.syncUsernames()
+	if err != nil {
+		log.Println(err)
 	}
+	identities := IdentityRepo{appC.db.C("identities")}
+	err = identities.EnsureIndexes()
+	if err != nil {
+		log.Println(err)
+	}
+	apikeys := APIKeyRepo{appC.db.C("apikeys")}
+	err = apikeys.EnsureIndexes()
+	if err != nil {
+		log.Println(err)
+	}
+	skills := SkillRepo{appC.db.C("skills"), appC.search}
+	err = skills.EnsureIndexes()
+	if err != nil {
+		log.Println(err)
+	}
+	err = appC.promoteSkillOwners()
+	if err != nil {
+		log.Println(err)
+	}
+	categories := CategoryRepo{appC.db.C("categories")}
+	err = categories.EnsureIndexes()
+	if err != nil {
+		log.Println(err)
+	}
+	err = categories.Seed()
+	if err != nil {
+		log.Println(err)
+	}
+	err = appC.adoptLegacyCategories()
+	if err != nil {
+		log.Println(err)
+	}
+	reviews := ReviewRepo{appC.db.C("reviews")}
+	err = reviews.ScrubLegacyAuthors()
+	if err != nil {
+		log.Println(err)
+	}
+	appC.purgeDeletedAccountsEvery(accountPurgeEvery)
 	commonHandlers := alice.New(context.ClearHandler, loggingHandler, recoverHandler)
 	router := NewRouter()
 
-	router.Post("/api/v0.1/auth", commonHandlers.ThenFunc(appC.authHandler))
-
-	router.Get("/api/v0.1/skills/:slug/reviews", commonHandlers.ThenFunc(appC.reviewsHandler))
-	router.Post("/api/v0.1/skills/:slug/reviews", commonHandlers.Append(appC.frontAuthHandler, bodyHandler(ReviewResource{})).ThenFunc(appC.newReviewHandler))
-
-	router.Get("/api/v0.1/skills/:slug", commonHandlers.Append(appC.frontAuthHandler).ThenFunc(appC.skillHandler))
-	router.Put("/api/v0.1/skills/:slug", commonHandlers.Append(appC.frontAuthHandler, bodyHandler(SkillResource{})).ThenFunc(appC.updateSkillHandler))
-	router.Post("/api/v0.1/skills/:slug", commonHandlers.Append(appC.frontAuthHandler, bodyHandler(SkillResource{})).ThenFunc(appC.updateSkillHandler))
+	router.Get("/.well-known/jwks.json", commonHandlers.ThenFunc(appC.jwksHandler))
+	if blobs, ok := appC.blobs.(*FileBlobStore); ok {
+		router.Get("/blobs/*key", commonHandlers.Then(http.StripPrefix("/blobs/", http.FileServer(http.Dir(blobs.Dir)))))
+	}
 
-	router.Delete("/api/v0.1/skills/:slug", commonHandlers.ThenFunc(appC.deleteSkillHandler))
-	router.Get("/api/v0.1/skills", commonHandlers.Append(appC.frontAuthHandler).ThenFunc(appC.skillsHandler))
-	router.Post("/api/v0.1/skills", commonHandlers.Append(appC.frontAuthHandler, bodyHandler(SkillResource{})).ThenFunc(appC.createSkillHandler))
+	router.Post("/api/v0.1/auth", commonHandlers.ThenFunc(appC.authHandler))
+	router.Post("/api/v0.1/auth/refresh", commonHandlers.Append(bodyHandler(TokenRequest{})).ThenFunc(appC.refreshHandler))
+	router.Post("/api/v0.1/auth/logout", commonHandlers.Append(appC.frontAuthHandler, humanHandler).ThenFunc(appC.logoutHandler))
+	router.Get("/api/v0.1/auth/verify", commonHandlers.ThenFunc(appC.verifyEmailHandler))
+	router.Post("/api/v0.1/auth/verify", commonHandlers.ThenFunc(appC.verifyEmailHandler))
+	router.Post("/api/v0.1/auth/2fa", commonHandlers.Append(bodyHandler(TwoFactorRequest{})).ThenFunc(appC.twoFactorLoginHandler))
+	router.Post("/api/v0.1/auth/phone", commonHandlers.Append(bodyHandler(PhoneRequest{})).ThenFunc(appC.phoneCodeHandler))
+	router.Post("/api/v0.1/auth/phone/verify", commonHandlers.Append(bodyHandler(PhoneRequest{})).ThenFunc(appC.phoneLoginHandler))
+	router.Post("/api/v0.1/auth/password/forgot", commonHandlers.Append(bodyHandler(PasswordRequest{})).ThenFunc(appC.forgotPasswordHandler))
+	router.Post("/api/v0.1/auth/password/reset", commonHandlers.Append(bodyHandler(PasswordRequest{})).ThenFunc(appC.resetPasswordHandler))
+
+	router.Get("/api/v0.1/skills/:slug/reviews", commonHandlers.Append(appC.frontAuthHandler, requireScope(PermReviewsRead)).ThenFunc(appC.reviewsHandler))
+	router.Post("/api/v0.1/skills/:slug/reviews", commonHandlers.Append(appC.frontAuthHandler, requirePermission(PermReviewsWrite), appC.verifiedHandler, bodyHandler(ReviewResource{})).ThenFunc(appC.newReviewHandler))
+
+	router.Post("/api/v0.1/skills/:slug/images", commonHandlers.Append(appC.frontAuthHandler, requirePermission(PermSkillsWrite)).ThenFunc(appC.uploadSkillImageHandler))
+	router.Delete("/api/v0.1/skills/:slug/images/:id", commonHandlers.Append(appC.frontAuthHandler, requirePermission(PermSkillsWrite)).ThenFunc(appC.deleteSkillImageHandler))
+
+	router.Get("/api/v0.1/skills/:slug", commonHandlers.Append(appC.frontAuthHandler, requireScope(PermSkillsRead)).ThenFunc(appC.skillHandler))
+	router.Put("/api/v0.1/skills/:slug", commonHandlers.Append(appC.frontAuthHandler, requirePermission(PermSkillsWrite), bodyHandler(SkillResource{})).ThenFunc(appC.updateSkillHandler))
+	router.Post("/api/v0.1/skills/:slug", commonHandlers.Append(appC.frontAuthHandler, requirePermission(PermSkillsWrite), bodyHandler(SkillResource{})).ThenFunc(appC.updateSkillHandler))
+
+	router.Delete("/api/v0.1/skills/:slug", commonHandlers.Append(appC.frontAuthHandler, requirePermission(PermSkillsWrite)).ThenFunc(appC.deleteSkillHandler))
+	router.Get("/api/v0.1/skills", commonHandlers.ThenFunc(appC.skillsHandler))
+	router.Get("/api/v0.1/categories", commonHandlers.ThenFunc(appC.categoriesHandler))
+	router.Post("/api/v0.1/categories", commonHandlers.Append(appC.frontAuthHandler, requirePermission(PermCategoriesAdmin), bodyHandler(CategoryResource{})).ThenFunc(appC.createCategoryHandler))
+	router.Get("/api/v0.1/categories/:slug", commonHandlers.ThenFunc(appC.categoryHandler))
+	router.Put("/api/v0.1/categories/:slug", commonHandlers.Append(appC.frontAuthHandler, requirePermission(PermCategoriesAdmin), bodyHandler(CategoryResource{})).ThenFunc(appC.updateCategoryHandler))
+	router.Delete("/api/v0.1/categories/:slug", commonHandlers.Append(appC.frontAuthHandler, requirePermission(PermCategoriesAdmin)).ThenFunc(appC.deleteCategoryHandler))
+	router.Get("/api/v0.1/search/skills", commonHandlers.ThenFunc(appC.skillSearchHandler))
+	router.Post("/api/v0.1/skills", commonHandlers.Append(appC.frontAuthHandler, requirePermission(PermSkillsWrite), appC.verifiedHandler, bodyHandler(SkillResource{})).ThenFunc(appC.createSkillHandler))
 
 	router.Get("/api/v0.1/user/:username/feeds", commonHandlers.Append(appC.frontAuthHandler).ThenFunc(appC.userFeedsHandler))
 
-	router.Get("/api/v0.1/user/:username/toggle-follow", commonHandlers.Append(appC.frontAuthHandler).ThenFunc(appC.toggleUserFollowHandler))
-	router.Get("/api/v0.1/user/:username", commonHandlers.ThenFunc(appC.userHandler))
+	router.Post("/api/v0.1/user/:username/follow", commonHandlers.Append(appC.frontAuthHandler).ThenFunc(appC.followHandler))
+	router.Delete("/api/v0.1/user/:username/follow", commonHandlers.Append(appC.frontAuthHandler).ThenFunc(appC.unfollowHandler))
+	router.Post("/api/v0.1/user/:username/block", commonHandlers.Append(appC.frontAuthHandler).ThenFunc(appC.blockHandler))
+	router.Delete("/api/v0.1/user/:username/block", commonHandlers.Append(appC.frontAuthHandler).ThenFunc(appC.unblockHandler))
+	router.Post("/api/v0.1/user/:username/mute", commonHandlers.Append(appC.frontAuthHandler).ThenFunc(appC.muteHandler))
+	router.Delete("/api/v0.1/user/:username/mute", commonHandlers.Append(appC.frontAuthHandler).ThenFunc(appC.unmuteHandler))
+	router.Get("/api/v0.1/user/:username/followers", commonHandlers.Append(appC.frontAuthHandler).ThenFunc(appC.followsHandler("followers")))
+	router.Get("/api/v0.1/user/:username/following", commonHandlers.Append(appC.frontAuthHandler).ThenFunc(appC.followsHandler("following")))
+	router.Get("/api/v0.1/users", commonHandlers.Append(appC.frontAuthHandler).ThenFunc(appC.usersHandler))
+	router.Get("/api/v0.1/user/:username", commonHandlers.Append(appC.frontAuthHandler).ThenFunc(appC.userHandler))
+	router.Delete("/api/v0.1/user/:username/lock", commonHandlers.Append(appC.frontAuthHandler, requirePermission(PermUsersAdmin)).ThenFunc(appC.unlockUserHandler))
+	router.Get("/api/v0.1/user/:username/apikeys", commonHandlers.Append(appC.frontAuthHandler, humanHandler, requirePermission(PermUsersAdmin)).ThenFunc(appC.apiKeysHandler))
+	router.Delete("/api/v0.1/user/:username/apikeys/:id", commonHandlers.Append(appC.frontAuthHandler, humanHandler, requirePermission(PermUsersAdmin)).ThenFunc(appC.deleteAPIKeyHandler))
+	router.Put("/api/v0.1/user/:username/role", commonHandlers.Append(appC.frontAuthHandler, requireRole(RoleAdmin), bodyHandler(RoleRequest{})).ThenFunc(appC.userRoleHandler))
 
 	router.Get("/api/v0.1/me", commonHandlers.Append(appC.frontAuthHandler).ThenFunc(appC.meHandler))
 
+	router.Post("/api/v0.1/me/username", commonHandlers.Append(bodyHandler(UsernameRequest{})).ThenFunc(appC.claimUsernameHandler))
+	router.Get("/api/v0.1/usernames/:name/available", commonHandlers.ThenFunc(appC.usernameAvailableHandler))
+	router.Get("/api/v0.1/me/export", commonHandlers.Append(appC.frontAuthHandler, humanHandler).ThenFunc(appC.exportAccountHandler))
+	router.Put("/api/v0.1/me", commonHandlers.Append(appC.frontAuthHandler, humanHandler, bodyHandler(ProfileRequest{})).ThenFunc(appC.updateProfileHandler))
+	router.Patch("/api/v0.1/me", commonHandlers.Append(appC.frontAuthHandler, humanHandler, bodyHandler(ProfileRequest{})).ThenFunc(appC.updateProfileHandler))
+	router.Put("/api/v0.1/me/avatar", commonHandlers.Append(appC.frontAuthHandler, humanHandler).ThenFunc(appC.uploadAvatarHandler))
+	router.Delete("/api/v0.1/me/avatar", commonHandlers.Append(appC.frontAuthHandler, humanHandler).ThenFunc(appC.deleteAvatarHandler))
+	router.Delete("/api/v0.1/me", commonHandlers.Append(appC.frontAuthHandler, humanHandler).ThenFunc(appC.deleteAccountHandler))
+	router.Post("/api/v0.1/me/provider", commonHandlers.Append(appC.frontAuthHandler, humanHandler).ThenFunc(appC.becomeProviderHandler))
+	router.Get("/api/v0.1/me/skills", commonHandlers.Append(appC.frontAuthHandler, requirePermission(PermSkillsRead)).ThenFunc(appC.mySkillsHandler))
+	router.Get("/api/v0.1/me/blocked", commonHandlers.Append(appC.frontAuthHandler).ThenFunc(appC.relationsHandler("blocked")))
+	router.Get("/api/v0.1/me/muted", commonHandlers.Append(appC.frontAuthHandler).ThenFunc(appC.relationsHandler("muted")))
+	router.Get("/api/v0.1/me/sessions", commonHandlers.Append(appC.frontAuthHandler, humanHandler).ThenFunc(appC.sessionsHandler))
+	router.Delete("/api/v0.1/me/sessions", commonHandlers.Append(appC.frontAuthHandler, humanHandler).ThenFunc(appC.deleteOtherSessionsHandler))
+	router.Delete("/api/v0.1/me/sessions/:id", commonHandlers.Append(appC.frontAuthHandler, humanHandler).ThenFunc(appC.deleteSessionHandler))
+	router.Post("/api/v0.1/me/2fa", commonHandlers.Append(appC.frontAuthHandler, humanHandler).ThenFunc(appC.enrollTwoFactorHandler))
+	router.Post("/api/v0.1/me/2fa/confirm", commonHandlers.Append(appC.frontAuthHandler, humanHandler, bodyHandler(TwoFactorRequest{})).ThenFunc(appC.confirmTwoFactorHandler))
+	router.Delete("/api/v0.1/me/2fa", commonHandlers.Append(appC.frontAuthHandler, humanHandler, bodyHandler(TwoFactorRequest{})).ThenFunc(appC.disableTwoFactorHandler))
+	router.Get("/api/v0.1/me/identities", commonHandlers.Append(appC.frontAuthHandler, humanHandler).ThenFunc(appC.identitiesHandler))
+	router.Post("/api/v0.1/me/identities", commonHandlers.Append(appC.frontAuthHandler, humanHandler, bodyHandler(User{})).ThenFunc(appC.linkIdentityHandler))
+	router.Delete("/api/v0.1/me/identities/:provider", commonHandlers.Append(appC.frontAuthHandler, humanHandler).ThenFunc(appC.unlinkIdentityHandler))
+	router.Get("/api/v0.1/me/apikeys", commonHandlers.Append(appC.frontAuthHandler, humanHandler).ThenFunc(appC.apiKeysHandler))
+	router.Post("/api/v0.1/me/apikeys", commonHandlers.Append(appC.frontAuthHandler, humanHandler, bodyHandler(APIKeyRequest{})).ThenFunc(appC.createAPIKeyHandler))
+	router.Delete("/api/v0.1/me/apikeys/:id", commonHandlers.Append(appC.frontAuthHandler, humanHandler).ThenFunc(appC.deleteAPIKeyHandler))
+	router.Post("/api/v0.1/me/phone", commonHandlers.Append(appC.frontAuthHandler, humanHandler, bodyHandler(PhoneRequest{})).ThenFunc(appC.phoneVerifyCodeHandler))
+	router.Post("/api/v0.1/me/phone/verify", commonHandlers.Append(appC.frontAuthHandler, humanHandler, bodyHandler(PhoneRequest{})).ThenFunc(appC.verifyPhoneHandler))
+	router.Post("/api/v0.1/me/verify-email", commonHandlers.Append(appC.frontAuthHandler).ThenFunc(appC.resendVerificationHandler))
+
 	router.Get("/api/v0.1/me/feeds", commonHandlers.Append(appC.frontAuthHandler).ThenFunc(appC.userFeedsHandler))
 
 	PORT := os.Getenv("PORT")
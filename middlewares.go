@@ -2,7 +2,6 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
 	"log"
 	"net/http"
 	"reflect"
@@ -96,6 +95,11 @@ func (ac *appContext) frontAuthHandler(next http.Handler) http.Handler {
 
 		var tokenValue string
 
+		if key := r.Header.Get(apiKeyHeader); key != "" {
+			ac.apiKeyHandler(key, next, w, r)
+			return
+		}
+
 		// check if we have a cookie with out tokenName
 		headerToken := r.Header.Get("X-AUTH-TOKEN")
 		//log.Println(headerToken)
@@ -111,30 +115,24 @@ func (ac *appContext) frontAuthHandler(next http.Handler) http.Handler {
 			//log.Println(ac.token)
 			//log.Println(tokenCookie)
 
+			// no token at all is fine, the request just carries on
+			// anonymous and whatever comes next decides if that's ok
 			switch {
 			case err == http.ErrNoCookie:
-				//w.WriteHeader(http.StatusUnauthorized)
-				//fmt.Fprintln(w, "No Token, no fun!")
 				next.ServeHTTP(w, r)
+				return
 
 			case err != nil:
-				//w.WriteHeader(http.StatusInternalServerError)
-				//fmt.Fprintln(w, "Error while Parsing cookie!")
 				log.Printf("Cookie parse error: %v\n", err)
 				next.ServeHTTP(w, r)
+				return
 			}
 
 			tokenValue = tokenCookie.Value
 
 		}
 		// validate the token
-		token, err := jwt.Parse(tokenValue, func(token *jwt.Token) (interface{}, error) {
-			// since we only use the one private key to sign
-			// the tokens,
-			// we also only use its public counter
-			// part to verify
-			return ac.verifyKey, nil
-		})
+		token, err := jwt.Parse(tokenValue, ac.keyFunc)
 
 		// branch out into the possible error from signing
 		switch err.(type) {
@@ -142,9 +140,9 @@ func (ac *appContext) frontAuthHandler(next http.Handler) http.Handler {
 		case nil: // no error
 
 			if !token.Valid { // but may still be invalid
-				w.WriteHeader(http.StatusUnauthorized)
-				fmt.Fprintln(w, "WHAT? Invalid Token? F*** off!")
 				log.Println("Invalid Token.... Hack attempt?")
+				WriteError(w, ErrUnauthorized)
+				return
 			}
 
 			//log.Println("Someone accessed resricted area! Token:%+v\n", token)
@@ -152,7 +150,24 @@ func (ac *appContext) frontAuthHandler(next http.Handler) http.Handler {
 			//w.WriteHeader(http.StatusOK)
 			//fmt.Fprintln(w, "restricted Area")
 
+			// purpose tokens (email verification and co) are
+			// signed with the same key but are not access tokens
+			if _, ok := token.Claims["purpose"]; ok {
+				WriteError(w, ErrUnauthorized)
+				return
+			}
+
+			revoked, err := ac.isTokenRevoked(token.Claims)
+			if err != nil {
+				log.Println(err)
+			}
+			if revoked {
+				WriteError(w, ErrTokenRevoked)
+				return
+			}
+
 			context.Set(r, "User", token.Claims["User"])
+			context.Set(r, "Claims", token.Claims)
 			//log.Println(token.Claims["User"])
 			next.ServeHTTP(w, r)
 
@@ -161,25 +176,48 @@ func (ac *appContext) frontAuthHandler(next http.Handler) http.Handler {
 
 			switch vErr.Errors {
 			case jwt.ValidationErrorExpired:
-				w.WriteHeader(http.StatusUnauthorized)
-				fmt.Fprintln(w, "Token Expired, get a new one.")
-				next.ServeHTTP(w, r)
+				WriteError(w, ErrTokenExpired)
 
 			default:
-				w.WriteHeader(http.StatusInternalServerError)
-				fmt.Fprintln(w, "Error while Parsing Token!")
 				log.Printf("ValidationError error: %+v\n", vErr.Errors)
-				next.ServeHTTP(w, r)
+				WriteError(w, ErrUnauthorized)
 			}
 
 		default: // something else went wrong
-			//w.WriteHeader(http.StatusInternalServerError)
-			//fmt.Fprintln(w, "Error while Parsing Token!")
 			log.Printf("Token parse error: %v\n", err)
-			next.ServeHTTP(w, r)
+			WriteError(w, ErrUnauthorized)
 		}
 
 	}
 	return http.HandlerFunc(fn)
 
 }
+
+//verifiedHandler stops accounts that have not verified their email from going further. It
+//checks the database, not the token, so verifying takes effect without signing in again
+func (ac *appContext) verifiedHandler(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		user, err := userget(r)
+		if err != nil || user.Username == "" {
+			WriteError(w, ErrUnauthorized)
+			return
+		}
+
+		repo := UserRepo{ac.db.C("users")}
+		userD, err := repo.Find(user.Username)
+		if err != nil {
+			log.Println(err)
+			WriteError(w, ErrUnauthorized)
+			return
+		}
+
+		if !userD.Data.isVerified() {
+			WriteError(w, ErrEmailNotVerified)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
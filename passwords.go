@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/context"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/redis.v2"
+)
+
+const (
+	//PasswordResetTTL is how long a password reset link stays valid
+	PasswordResetTTL = time.Hour
+
+	//MinPasswordLength is the shortest password we accept for local accounts
+	MinPasswordLength = 8
+)
+
+//PasswordRequest is the body of the forgot and reset password endpoints
+type PasswordRequest struct {
+	Email    string `json:"email"`
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+//Utility methods
+
+// a user only ever has one live reset token, asking for a new one kills the
+// last one
+var newPasswordResetRedisScript = redis.NewScript(`
+	local old = redis.call("get", "password-reset:email:"..ARGV[1])
+	if old then
+		redis.call("del", "password-reset:"..old)
+	end
+	redis.call("set", "password-reset:"..KEYS[1], ARGV[1], "EX", ARGV[2])
+	redis.call("set", "password-reset:email:"..ARGV[1], KEYS[1], "EX", ARGV[2])
+	return 1
+`)
+
+var usePasswordResetRedisScript = redis.NewScript(`
+	local email = redis.call("get", "password-reset:"..KEYS[1])
+	if not email then
+		return ""
+	end
+	redis.call("del", "password-reset:"..KEYS[1])
+	redis.call("del", "password-reset:email:"..email)
+	return email
+`)
+
+//resetURLFromEnv returns the page of the front end that takes a reset token and asks for
+//the new password, RESETURL. The token is added to it as ?token=
+func resetURLFromEnv(rootURL string) string {
+	resetURL := os.Getenv("RESETURL")
+	if resetURL == "" {
+		resetURL = rootURL + "/password/reset"
+		log.Println("No RESETURL set, password reset links would point at", resetURL)
+	}
+	return resetURL
+}
+
+//sendPasswordReset mails a reset link to the local account with email, if there is one.
+//Only the hash of the token is kept in redis
+func (c *appContext) sendPasswordReset(email string) error {
+	var user User
+	err := c.db.C("users").Find(bson.M{
+		"provider": "local",
+		"email":    email,
+	}).One(&user)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	token, err := randToken(32)
+	if err != nil {
+		return err
+	}
+
+	ttl := strconv.FormatInt(int64(PasswordResetTTL/time.Second), 10)
+	err = newPasswordResetRedisScript.Run(c.redis, []string{hashToken(token)}, []string{email, ttl}).Err()
+	if err != nil {
+		return err
+	}
+
+	link, err := url.Parse(c.resetURL)
+	if err != nil {
+		return err
+	}
+	q := link.Query()
+	q.Set("token", token)
+	link.RawQuery = q.Encode()
+
+	body := "Hi " + user.Name + ",\n\n" +
+		"Someone asked to reset the password of your oddjobz account. Open the link below to choose a new one:\n\n" +
+		link.String() + "\n\n" +
+		"The link expires in an hour. If it wasn't you, you can ignore this email, your password has not changed."
+
+	return c.mailer.Send(email, "Reset your oddjobz password", body)
+}
+
+//resetPassword burns a reset token, sets the new password on the account it was issued for
+//and signs that account out everywhere
+func (c *appContext) resetPassword(token, password string) error {
+	resp, err := usePasswordResetRedisScript.Run(c.redis, []string{hashToken(token)}, []string{}).Result()
+	if err != nil {
+		return err
+	}
+	email, _ := resp.(string)
+	if email == "" {
+		return errPurposeTokenInvalid
+	}
+
+	phash, err := bcrypt.GenerateFromPassword([]byte(password), Cost)
+	if err != nil {
+		return err
+	}
+
+	var user User
+	change := mgo.Change{
+		Update: bson.M{
+			"$set": bson.M{"password": phash},
+		},
+		ReturnNew: true,
+	}
+	_, err = c.db.C("users").Find(bson.M{
+		"provider": "local",
+		"email":    email,
+	}).Apply(change, &user)
+	if err != nil {
+		return err
+	}
+
+	if user.Username == "" {
+		return nil
+	}
+	return c.revokeAllTokens(user.Username)
+}
+
+//Handlers
+
+func (c *appContext) forgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	body := context.Get(r, "body").(*PasswordRequest)
+
+	// the reply never depends on the email, and the lookup runs in the
+	// background, so nobody can use this endpoint to find out who has an account
+	go func(email string) {
+		err := c.sendPasswordReset(email)
+		if err != nil {
+			log.Println(err)
+		}
+	}(body.Email)
+
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(struct {
+		Message string `json:"message"`
+	}{"If an account exists for that email, a reset link is on its way"})
+}
+
+func (c *appContext) resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	body := context.Get(r, "body").(*PasswordRequest)
+	if len(body.Password) < MinPasswordLength {
+		WriteError(w, ErrPasswordTooShort)
+		return
+	}
+
+	err := c.resetPassword(body.Token, body.Password)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInvalidResetToken)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(struct {
+		Message string `json:"message"`
+	}{"Password changed, sign in with your new password"})
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/context"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/redis.v2"
+)
+
+const (
+	//PhoneOTPTTL is how long a texted code stays valid
+	PhoneOTPTTL = time.Minute * 10
+
+	//PhoneOTPAttempts is how many wrong codes a texted code survives
+	PhoneOTPAttempts = 5
+
+	//PhoneOTPCooldown is how long a number has to wait between texts
+	PhoneOTPCooldown = time.Minute
+
+	//PhoneOTPWindow and PhoneOTPMaxSends cap how many texts a number gets
+	PhoneOTPWindow   = time.Hour
+	PhoneOTPMaxSends = 5
+
+	//PhoneOTPMaxSendsPerIP caps how many texts one client can ask for in the window,
+	//whatever the numbers
+	PhoneOTPMaxSendsPerIP = 20
+
+	phoneProvider      = "phone"
+	phoneLoginPurpose  = "login"
+	phoneVerifyPurpose = "verify"
+	phoneOTPDigits     = 6
+)
+
+var (
+	errInvalidPhone = errors.New("not a valid phone number")
+	errOTPInvalid   = errors.New("invalid or expired code")
+	e164Pattern     = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+)
+
+//PhoneRequest is the body of the phone endpoints
+type PhoneRequest struct {
+	Phone string `json:"phone"`
+	Code  string `json:"code,omitempty"`
+}
+
+//Utility methods
+
+//normalizePhone turns whatever the user typed into E.164. Numbers without a country
+//code are taken to be local to PHONECOUNTRYCODE
+func normalizePhone(raw string) (string, error) {
+	var b strings.Builder
+	for i, r := range strings.TrimSpace(raw) {
+		switch {
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case r == '+' && i == 0:
+			b.WriteRune(r)
+		case r == ' ' || r == '-' || r == '.' || r == '(' || r == ')':
+		default:
+			return "", errInvalidPhone
+		}
+	}
+	phone := b.String()
+
+	switch {
+	case strings.HasPrefix(phone, "+"):
+	case strings.HasPrefix(phone, "00"):
+		phone = "+" + phone[2:]
+	default:
+		cc := strings.TrimPrefix(os.Getenv("PHONECOUNTRYCODE"), "+")
+		if cc == "" {
+			return "", errInvalidPhone
+		}
+		phone = "+" + cc + strings.TrimPrefix(phone, "0")
+	}
+
+	if !e164Pattern.MatchString(phone) {
+		return "", errInvalidPhone
+	}
+	return phone, nil
+}
+
+//newOTP returns a random numeric code
+func newOTP() (string, error) {
+	max := big.NewInt(1)
+	for i := 0; i < phoneOTPDigits; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", phoneOTPDigits, n), nil
+}
+
+//otpKey is where the code for phone and purpose lives, the send limits are shared
+//between purposes under "otp:<phone>"
+func otpKey(phone, purpose string) string {
+	return "otp:" + phone + ":" + purpose
+}
+
+// returns {state, seconds}: 1 while the number is cooling down, 2 when it
+// has had all its texts for the window, 0 when the code was stored
+var newOTPRedisScript = redis.NewScript(`
+	local cooldown = redis.call("ttl", KEYS[1]..":cooldown")
+	if cooldown > 0 then
+		return {1, cooldown}
+	end
+	local sent = redis.call("incr", KEYS[1]..":sent")
+	if sent == 1 then
+		redis.call("expire", KEYS[1]..":sent", ARGV[4])
+	end
+	if sent > tonumber(ARGV[5]) then
+		return {2, redis.call("ttl", KEYS[1]..":sent")}
+	end
+	redis.call("set", KEYS[2], ARGV[1], "EX", ARGV[2])
+	redis.call("del", KEYS[2]..":attempts")
+	redis.call("set", KEYS[1]..":cooldown", 1, "EX", ARGV[3])
+	return {0, 0}
+`)
+
+//sendOTP texts a fresh code for purpose to phone. It returns how long to wait when
+//the number or the client has asked for too many
+func (c *appContext) sendOTP(phone, purpose, ip string) (time.Duration, error) {
+	n, err := c.increx("otp:ip:"+ip, PhoneOTPWindow)
+	if err != nil {
+		return 0, err
+	}
+	if n > PhoneOTPMaxSendsPerIP {
+		return PhoneOTPWindow, nil
+	}
+
+	code, err := newOTP()
+	if err != nil {
+		return 0, err
+	}
+
+	secs := func(d time.Duration) string { return strconv.FormatInt(int64(d/time.Second), 10) }
+	resp, err := newOTPRedisScript.Run(c.redis, []string{"otp:" + phone, otpKey(phone, purpose)}, []string{
+		hashToken(phone + ":" + code),
+		secs(PhoneOTPTTL),
+		secs(PhoneOTPCooldown),
+		secs(PhoneOTPWindow),
+		strconv.Itoa(PhoneOTPMaxSends),
+	}).Result()
+	if err != nil {
+		return 0, err
+	}
+	fields := resp.([]interface{})
+	if fields[0].(int64) != 0 {
+		return time.Duration(fields[1].(int64)) * time.Second, nil
+	}
+
+	return 0, c.sms.Send(phone, "Your oddjobz code is "+code+". It expires in 10 minutes.")
+}
+
+var checkOTPRedisScript = redis.NewScript(`
+	local stored = redis.call("get", KEYS[1])
+	if not stored then
+		return 0
+	end
+	local n = redis.call("incr", KEYS[1]..":attempts")
+	if n == 1 then
+		redis.call("expire", KEYS[1]..":attempts", ARGV[3])
+	end
+	if n > tonumber(ARGV[2]) then
+		redis.call("del", KEYS[1], KEYS[1]..":attempts")
+		return 0
+	end
+	if stored ~= ARGV[1] then
+		return 0
+	end
+	redis.call("del", KEYS[1], KEYS[1]..":attempts")
+	return 1
+`)
+
+//checkOTP uses up the code texted to phone for purpose, if code is it
+func (c *appContext) checkOTP(phone, purpose, code string) error {
+	resp, err := checkOTPRedisScript.Run(c.redis, []string{otpKey(phone, purpose)}, []string{
+		hashToken(phone + ":" + code),
+		strconv.Itoa(PhoneOTPAttempts),
+		strconv.FormatInt(int64(PhoneOTPTTL/time.Second), 10),
+	}).Result()
+	if err != nil {
+		return err
+	}
+	if resp.(int64) != 1 {
+		return errOTPInvalid
+	}
+	return nil
+}
+
+//phoneUser returns the account phone signs in to, making one if this is the first time
+//we see the number
+func (c *appContext) phoneUser(phone string) (*User, error) {
+	user, err := c.linkedUser(&ProviderIdentity{Provider: phoneProvider, PID: phone})
+	if err != mgo.ErrNotFound {
+		return user, err
+	}
+
+	result := User{}
+	_, err = c.db.C("users").Find(bson.M{"pid": phone, "provider": phoneProvider}).Apply(mgo.Change{
+		Update: bson.M{"$set": bson.M{
+			"phone":         phone,
+			"phoneverified": true,
+		}},
+		Upsert:    true,
+		ReturnNew: true,
+	}, &result)
+	if err != nil {
+		return nil, err
+	}
+	c.ensureIdentity(bson.M{"pid": phone, "provider": phoneProvider}, phoneProvider, phone)
+	return &result, nil
+}
+
+//writeOTPSent answers a request for a code
+func (c *appContext) writeOTPSent(w http.ResponseWriter, r *http.Request, purpose string) {
+	body := context.Get(r, "body").(*PhoneRequest)
+	phone, err := normalizePhone(body.Phone)
+	if err != nil {
+		WriteError(w, ErrInvalidPhone)
+		return
+	}
+
+	wait, err := c.sendOTP(phone, purpose, clientIP(r))
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", seconds(wait))
+		WriteError(w, ErrTooManyAttempts)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+//Handlers
+
+func (c *appContext) phoneCodeHandler(w http.ResponseWriter, r *http.Request) {
+	c.writeOTPSent(w, r, phoneLoginPurpose)
+}
+
+func (c *appContext) phoneLoginHandler(w http.ResponseWriter, r *http.Request) {
+	body := context.Get(r, "body").(*PhoneRequest)
+	phone, err := normalizePhone(body.Phone)
+	if err != nil {
+		WriteError(w, ErrInvalidPhone)
+		return
+	}
+
+	err = c.checkOTP(phone, phoneLoginPurpose, body.Code)
+	if err == errOTPInvalid {
+		WriteError(w, ErrInvalidOTP)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	user, err := c.phoneUser(phone)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	c.writeSignIn(w, r, user, "Signed in")
+}
+
+func (c *appContext) phoneVerifyCodeHandler(w http.ResponseWriter, r *http.Request) {
+	c.writeOTPSent(w, r, phoneVerifyPurpose)
+}
+
+func (c *appContext) verifyPhoneHandler(w http.ResponseWriter, r *http.Request) {
+	body := context.Get(r, "body").(*PhoneRequest)
+	user, err := c.currentUser(r)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrUnauthorized)
+		return
+	}
+
+	phone, err := normalizePhone(body.Phone)
+	if err != nil {
+		WriteError(w, ErrInvalidPhone)
+		return
+	}
+
+	err = c.checkOTP(phone, phoneVerifyPurpose, body.Code)
+	if err == errOTPInvalid {
+		WriteError(w, ErrInvalidOTP)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	repo := UserRepo{c.db.C("users")}
+	id, err := repo.userID(bson.M{"username": user.Username})
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrUnauthorized)
+		return
+	}
+
+	// the verified number becomes a way to sign in, so it can only
+	// belong to one account
+	ids := IdentityRepo{c.db.C("identities")}
+	err = ids.Link(lookUp{Provider: phoneProvider, ProviderUID: phone, UserID: id})
+	if err == errIdentityTaken {
+		WriteError(w, ErrIdentityTaken)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	if user.PhoneVerified && user.Phone != "" && user.Phone != phone {
+		err = ids.coll.Remove(bson.M{"provider": phoneProvider, "provideruid": user.Phone, "userid": id})
+		if err != nil && err != mgo.ErrNotFound {
+			log.Println(err)
+		}
+	}
+
+	err = c.db.C("users").Update(bson.M{
+		"username": user.Username,
+	}, bson.M{
+		"$set": bson.M{"phone": phone, "phoneverified": true},
+	})
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestNormalizePhone(t *testing.T) {
+	old := os.Getenv("PHONECOUNTRYCODE")
+	defer os.Setenv("PHONECOUNTRYCODE", old)
+
+	tests := []struct {
+		cc, raw string
+		want    string
+		err     error
+	}{
+		{"234", "+2348031234567", "+2348031234567", nil},
+		{"234", " +234 803 123 4567 ", "+2348031234567", nil},
+		{"234", "+234 (803) 123-4567", "+2348031234567", nil},
+		{"234", "002348031234567", "+2348031234567", nil},
+		{"234", "08031234567", "+2348031234567", nil},
+		{"+234", "803.123.4567", "+2348031234567", nil},
+		{"", "+447911123456", "+447911123456", nil},
+		{"", "08031234567", "", errInvalidPhone},
+		{"234", "0803123456a", "", errInvalidPhone},
+		{"234", "234+8031234567", "", errInvalidPhone},
+		{"234", "+0348031234567", "", errInvalidPhone},
+		{"234", "+12345", "", errInvalidPhone},
+		{"234", "+1234567890123456", "", errInvalidPhone},
+		{"234", "", "", errInvalidPhone},
+	}
+	for _, tt := range tests {
+		os.Setenv("PHONECOUNTRYCODE", tt.cc)
+		got, err := normalizePhone(tt.raw)
+		if got != tt.want || err != tt.err {
+			t.Errorf("normalizePhone(%q) with code %q = %q, %v, want %q, %v", tt.raw, tt.cc, got, err, tt.want, tt.err)
+		}
+	}
+}
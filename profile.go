@@ -0,0 +1,199 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/context"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	//MaxNameLength is the longest display name we keep
+	MaxNameLength = 100
+
+	//MaxBioLength is the longest bio we keep
+	MaxBioLength = 500
+
+	maxGenderLength = 32
+	maxCityLength   = 100
+	maxURLLength    = 2048
+)
+
+//ProfileRequest is the body of PUT and PATCH /me. Fields left out of a PATCH are
+//not touched, fields left out of a PUT are cleared
+type ProfileRequest struct {
+	Name   *string `json:"name"`
+	Image  *string `json:"image"`
+	Gender *string `json:"gender"`
+	Link   *string `json:"link"`
+	Phone  *string `json:"phone"`
+	Bio    *string `json:"bio"`
+	City   *string `json:"city"`
+}
+
+//Utility methods
+
+//validURL reports whether s is an absolute http or https url
+func validURL(s string) bool {
+	if len(s) > maxURLLength {
+		return false
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+//profileUpdate checks body and turns it into the $set for the user document, with
+//replace every editable field is set, missing ones to empty
+func profileUpdate(user *User, body *ProfileRequest, replace bool) (bson.M, *Error) {
+	set := bson.M{}
+	field := func(v *string) (string, bool) {
+		if v == nil {
+			return "", replace
+		}
+		return strings.TrimSpace(*v), true
+	}
+
+	if name, ok := field(body.Name); ok {
+		if name == "" || utf8.RuneCountInString(name) > MaxNameLength {
+			return nil, ErrInvalidProfile
+		}
+		set["name"] = name
+	}
+	if image, ok := field(body.Image); ok {
+		if image != "" && !validURL(image) {
+			return nil, ErrInvalidProfile
+		}
+		set["image"] = image
+	}
+	if gender, ok := field(body.Gender); ok {
+		if utf8.RuneCountInString(gender) > maxGenderLength {
+			return nil, ErrInvalidProfile
+		}
+		set["gender"] = gender
+	}
+	if link, ok := field(body.Link); ok {
+		if link != "" && !validURL(link) {
+			return nil, ErrInvalidProfile
+		}
+		set["link"] = link
+	}
+	if phone, ok := field(body.Phone); ok {
+		if phone != "" {
+			var err error
+			phone, err = normalizePhone(phone)
+			if err != nil {
+				return nil, ErrInvalidPhone
+			}
+		}
+		set["phone"] = phone
+		// a new number has to be verified again
+		if phone != user.Phone {
+			set["phoneverified"] = false
+		}
+	}
+	if bio, ok := field(body.Bio); ok {
+		if utf8.RuneCountInString(bio) > MaxBioLength {
+			return nil, ErrInvalidProfile
+		}
+		set["bio"] = bio
+	}
+	if city, ok := field(body.City); ok {
+		if utf8.RuneCountInString(city) > maxCityLength {
+			return nil, ErrInvalidProfile
+		}
+		set["city"] = city
+	}
+
+	return set, nil
+}
+
+//Handlers
+
+//updateProfileHandler serves both PUT and PATCH /me, and sends back a new access token
+//so the user in the claims matches the profile
+func (c *appContext) updateProfileHandler(w http.ResponseWriter, r *http.Request) {
+	body := context.Get(r, "body").(*ProfileRequest)
+	user, err := c.currentUser(r)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrUnauthorized)
+		return
+	}
+
+	set, e := profileUpdate(user, body, r.Method == "PUT")
+	if e != nil {
+		WriteError(w, e)
+		return
+	}
+
+	// the old number stops being a way to sign in, as it does when a new
+	// one is verified, unless it is the only way left
+	if phone, ok := set["phone"].(string); ok && phone != user.Phone && user.PhoneVerified && user.Phone != "" {
+		repo := UserRepo{c.db.C("users")}
+		id, err := repo.userID(bson.M{"username": user.Username})
+		if err != nil {
+			log.Println(err)
+			WriteError(w, ErrInternalServer)
+			return
+		}
+		ids := IdentityRepo{c.db.C("identities")}
+		_, err = ids.Unlink(id, phoneProvider)
+		switch err {
+		case nil, errIdentityNotFound:
+		case errLastLoginMethod:
+			WriteError(w, ErrLastLoginMethod)
+			return
+		default:
+			log.Println(err)
+			WriteError(w, ErrInternalServer)
+			return
+		}
+	}
+
+	// an image set by url replaces an uploaded one
+	replaced := user.Avatar != nil && set["image"] != nil && set["image"] != user.Avatar.Full
+
+	// an empty PATCH has nothing to write, and older mongos turn down an empty $set
+	updated := *user
+	if len(set) > 0 {
+		update := bson.M{"$set": set}
+		if replaced {
+			update["$unset"] = bson.M{"avatar": ""}
+		}
+
+		updated = User{}
+		_, err = c.db.C("users").Find(bson.M{
+			"username": user.Username,
+		}).Apply(mgo.Change{
+			Update:    update,
+			ReturnNew: true,
+		}, &updated)
+		if err != nil {
+			log.Println(err)
+			WriteError(w, ErrInternalServer)
+			return
+		}
+	}
+	if replaced {
+		c.deleteImages(*user.Avatar)
+	}
+	updated.Password = ""
+
+	sid, _ := claimsget(r)["sid"].(string)
+	token, err := c.signToken(&updated, sid)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	c.writeTokens(w, &updated, "Profile updated", token, "")
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+var (
+	errUnknownProvider = errors.New("unsupported provider")
+	errUnknownKey      = errors.New("no key found for token")
+	errMissingIDToken  = errors.New("an id_token from the provider is required")
+)
+
+//ProviderIdentity is what a provider vouches for about a user once their id token checks out
+type ProviderIdentity struct {
+	Provider      string
+	PID           string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Image         string
+}
+
+//ProviderVerifier checks an id token issued by a third party login provider, so we
+//never have to take the client's word for who the user is
+type ProviderVerifier interface {
+	Verify(idToken string) (*ProviderIdentity, error)
+}
+
+//KeySource hands out the public keys a provider signs its id tokens with
+type KeySource interface {
+	Key(kid string) (*rsa.PublicKey, error)
+}
+
+//OIDCVerifier verifies OpenID Connect id tokens: the signature against the provider's
+//JWKS, and the issuer, audience and expiry claims
+type OIDCVerifier struct {
+	Provider string
+	Issuers  []string
+	Audience string
+	Keys     KeySource
+}
+
+//Verify checks idToken and returns the identity in it
+func (v *OIDCVerifier) Verify(idToken string) (*ProviderIdentity, error) {
+	if idToken == "" {
+		return nil, errMissingIDToken
+	}
+
+	token, err := jwt.Parse(idToken, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		return v.Keys.Key(kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, errors.New("invalid id token")
+	}
+
+	claims := token.Claims
+	if _, ok := claims["exp"].(float64); !ok {
+		return nil, errors.New("id token has no expiry")
+	}
+
+	iss, _ := claims["iss"].(string)
+	if !contains(v.Issuers, iss) {
+		return nil, fmt.Errorf("unexpected issuer %q", iss)
+	}
+
+	if !audienceMatches(claims["aud"], v.Audience) {
+		return nil, fmt.Errorf("id token was not issued for %q", v.Audience)
+	}
+
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return nil, errors.New("id token has no subject")
+	}
+
+	identity := &ProviderIdentity{Provider: v.Provider, PID: sub}
+	identity.Email, _ = claims["email"].(string)
+	identity.Name, _ = claims["name"].(string)
+	identity.Image, _ = claims["picture"].(string)
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		identity.EmailVerified = verified
+	case string:
+		identity.EmailVerified = verified == "true"
+	}
+
+	return identity, nil
+}
+
+func audienceMatches(aud interface{}, audience string) bool {
+	if audience == "" {
+		return false
+	}
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+//JWKS
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+//parseJWKS reads the RSA keys out of a JWKS document, keyed by their key id
+func parseJWKS(data []byte) (map[string]*rsa.PublicKey, error) {
+	set := jsonWebKeySet{}
+	err := json.Unmarshal(data, &set)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
+
+//StaticJWKS is a fixed key set, read from a file. It stands in for a provider's
+//JWKS endpoint so logins can be tested offline
+type StaticJWKS struct {
+	keys map[string]*rsa.PublicKey
+}
+
+//NewStaticJWKS creates a StaticJWKS from a JWKS document
+func NewStaticJWKS(data []byte) (*StaticJWKS, error) {
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return nil, err
+	}
+	return &StaticJWKS{keys}, nil
+}
+
+//Key returns the key with id kid
+func (s *StaticJWKS) Key(kid string) (*rsa.PublicKey, error) {
+	key, ok := s.keys[kid]
+	if !ok {
+		return nil, errUnknownKey
+	}
+	return key, nil
+}
+
+//RemoteJWKS fetches a provider's JWKS over http and caches it. An unknown key id
+//triggers a refetch, since that is how providers roll their keys
+type RemoteJWKS struct {
+	URL    string
+	TTL    time.Duration
+	client *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+//NewRemoteJWKS creates a RemoteJWKS for url
+func NewRemoteJWKS(url string) *RemoteJWKS {
+	return &RemoteJWKS{
+		URL:    url,
+		TTL:    time.Hour,
+		client: &http.Client{Timeout: time.Second * 10},
+	}
+}
+
+//Key returns the key with id kid, fetching the key set when needed
+func (s *RemoteJWKS) Key(kid string) (*rsa.PublicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.keys[kid]
+	if ok && time.Since(s.fetched) < s.TTL {
+		return key, nil
+	}
+	// don't let a stream of made up key ids hammer the provider
+	if !ok && time.Since(s.fetched) < time.Minute {
+		return nil, errUnknownKey
+	}
+
+	resp, err := s.client.Get(s.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", s.URL, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return nil, err
+	}
+	s.keys = keys
+	s.fetched = time.Now()
+
+	key, ok = s.keys[kid]
+	if !ok {
+		return nil, errUnknownKey
+	}
+	return key, nil
+}
+
+//verifiersFromEnv sets up a verifier for every provider that has a client id configured.
+//Setting PROVIDERJWKSFILE makes every provider trust the keys in that file instead of
+//the real ones, for local development
+func verifiersFromEnv() map[string]ProviderVerifier {
+	verifiers := map[string]ProviderVerifier{}
+
+	var local KeySource
+	if path := os.Getenv("PROVIDERJWKSFILE"); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Fatal("Error reading PROVIDERJWKSFILE")
+		}
+		local, err = NewStaticJWKS(data)
+		if err != nil {
+			log.Fatal("Error parsing PROVIDERJWKSFILE")
+		}
+		log.Println("Provider id tokens would be checked against", path)
+	}
+
+	providers := []struct {
+		name, audienceEnv, jwks string
+		issuers                 []string
+	}{
+		{"google", "GOOGLECLIENTID", "https://www.googleapis.com/oauth2/v3/certs", []string{"https://accounts.google.com", "accounts.google.com"}},
+		{"facebook", "FACEBOOKAPPID", "https://www.facebook.com/.well-known/oauth/openid/jwks/", []string{"https://www.facebook.com"}},
+	}
+
+	for _, p := range providers {
+		audience := os.Getenv(p.audienceEnv)
+		if audience == "" {
+			log.Println("No", p.audienceEnv, "set,", p.name, "logins are disabled")
+			continue
+		}
+
+		keys := local
+		if keys == nil {
+			keys = NewRemoteJWKS(p.jwks)
+		}
+		verifiers[p.name] = &OIDCVerifier{
+			Provider: p.name,
+			Issuers:  p.issuers,
+			Audience: audience,
+			Keys:     keys,
+		}
+	}
+
+	return verifiers
+}
@@ -20,7 +20,7 @@ type Review struct {
 	SkillSlug string        `json:"skillslug"`
 	Review    string        `json:"review"`
 	Rating    int           `json:"rating"`
-	User      User          `json:"user,omitempty" bson:"omitempty"`
+	User      *PublicUser   `json:"user,omitempty" bson:"user,omitempty"`
 }
 
 //ReviewsCollection can carry a slice of reviews, and follws a jsn api standard when serialized
@@ -66,6 +66,17 @@ func (r *ReviewRepo) Create(review *Review) error {
 	return nil
 }
 
+//ScrubLegacyAuthors removes the author a review used to embed under "omitempty", the
+//whole user including their password hash
+func (r *ReviewRepo) ScrubLegacyAuthors() error {
+	_, err := r.coll.UpdateAll(bson.M{
+		"omitempty": bson.M{"$exists": true},
+	}, bson.M{
+		"$unset": bson.M{"omitempty": ""},
+	})
+	return err
+}
+
 //Handlers
 
 func (c *appContext) reviewsHandler(w http.ResponseWriter, r *http.Request) {
@@ -95,9 +106,55 @@ func (c *appContext) newReviewHandler(w http.ResponseWriter, r *http.Request) {
 	body := context.Get(r, "body").(*ReviewResource)
 	log.Println(skillslug)
 
+	if body.Data.Rating < 1 || body.Data.Rating > MaxRating {
+		WriteError(w, ErrInvalidRating)
+		return
+	}
+
+	skills := SkillRepo{c.db.C("skills"), c.search}
+	skill, err := skills.Find(skillslug)
+	if err == mgo.ErrNotFound {
+		WriteError(w, ErrNotFound)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	blocked, err := c.blockedBetween(skill.Data.Owner, user.Username)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	if blocked {
+		WriteError(w, ErrBlocked)
+		return
+	}
+
+	// the claims only carry the self view, the author is loaded so the
+	// review shows their role, avatar and counts
+	users := UserRepo{c.db.C("users")}
+	authorD, err := users.Find(user.Username)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrUnauthorized)
+		return
+	}
+	authored := []User{authorD.Data}
+	c.checkFollowedState(authored, "")
+	author := publicUser(&authored[0])
 	body.Data.SkillSlug = skillslug
 	body.Data.Username = user.Username
+	body.Data.User = &author
 	err = repo.Create(&body.Data)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	err = skills.AddRating(skillslug, body.Data.Rating)
 	if err != nil {
 		log.Println(err)
 	}
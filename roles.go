@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/context"
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Roles, stored in User.Permission and carried in the "AccessToken" claim.
+// Every role can do whatever the ones before it can. Customers hire and
+// review, listing skills is what makes someone a provider. Customers become
+// providers themselves with POST /me/provider, anything else is up to an admin.
+const (
+	RoleCustomer  = "customer"
+	RoleProvider  = "provider"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// Permissions are what the middlewares actually check, roles are just named
+// bundles of them.
+const (
+	PermSkillsRead      = "skills:read"
+	PermReviewsRead     = "reviews:read"
+	PermSkillsWrite     = "skills:write"
+	PermReviewsWrite    = "reviews:write"
+	PermSkillsModerate  = "skills:moderate"
+	PermReviewsModerate = "reviews:moderate"
+	PermUsersAdmin      = "users:admin"
+	PermCreditsAdmin    = "credits:admin"
+	PermCategoriesAdmin = "categories:admin"
+)
+
+var roleRank = map[string]int{
+	RoleCustomer:  0,
+	RoleProvider:  1,
+	RoleModerator: 2,
+	RoleAdmin:     3,
+}
+
+var rolePermissions = map[string][]string{
+	RoleCustomer:  {PermSkillsRead, PermReviewsRead, PermReviewsWrite},
+	RoleProvider:  {PermSkillsRead, PermReviewsRead, PermSkillsWrite, PermReviewsWrite},
+	RoleModerator: {PermSkillsRead, PermReviewsRead, PermSkillsWrite, PermReviewsWrite, PermSkillsModerate, PermReviewsModerate},
+	RoleAdmin:     {PermSkillsRead, PermReviewsRead, PermSkillsWrite, PermReviewsWrite, PermSkillsModerate, PermReviewsModerate, PermUsersAdmin, PermCreditsAdmin, PermCategoriesAdmin},
+}
+
+//RoleRequest is the body for changing a user's role
+type RoleRequest struct {
+	Role string `json:"role"`
+}
+
+//Utility methods
+
+//userRole returns the role in permission, users that were never given one are customers
+func userRole(permission string) string {
+	if _, ok := roleRank[permission]; ok {
+		return permission
+	}
+	return RoleCustomer
+}
+
+//hasRole reports whether role is at least as powerful as min
+func hasRole(role, min string) bool {
+	return roleRank[userRole(role)] >= roleRank[min]
+}
+
+//hasPermission reports whether role carries perm
+func hasPermission(role, perm string) bool {
+	for _, p := range rolePermissions[userRole(role)] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+//roleget returns the role of the user the current request was authenticated as,
+//and false when the request is anonymous
+func roleget(r *http.Request) (string, bool) {
+	claims := claimsget(r)
+	if _, ok := claims["User"]; !ok {
+		return "", false
+	}
+	permission, _ := claims["AccessToken"].(string)
+	return userRole(permission), true
+}
+
+//promoteSkillOwners makes providers of the customers that listed skills back when
+//customers could
+func (c *appContext) promoteSkillOwners() error {
+	owners := []string{}
+	err := c.db.C("skills").Find(nil).Distinct("owner", &owners)
+	if err != nil {
+		return err
+	}
+	info, err := c.db.C("users").UpdateAll(bson.M{
+		"username":   bson.M{"$in": owners},
+		"permission": bson.M{"$in": []interface{}{RoleCustomer, "", nil}},
+	}, bson.M{
+		"$set": bson.M{"permission": RoleProvider},
+	})
+	if err != nil {
+		return err
+	}
+	if info.Updated > 0 {
+		log.Printf("made %d skill owners providers\n", info.Updated)
+	}
+	return nil
+}
+
+//Middlewares
+
+//requireRole only lets requests through from users with at least role min, it
+//has to come after frontAuthHandler in the chain
+func requireRole(min string) func(http.Handler) http.Handler {
+	m := func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			// an api key stands in for a role only if it was given
+			// everything that role can do
+			if isAPIKeyRequest(r) && !scopeAPIKey(r, rolePermissions[min]...) {
+				WriteError(w, ErrForbidden)
+				return
+			}
+			role, ok := roleget(r)
+			if !ok {
+				WriteError(w, ErrUnauthorized)
+				return
+			}
+			if !hasRole(role, min) {
+				WriteError(w, ErrForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		}
+
+		return http.HandlerFunc(fn)
+	}
+
+	return m
+}
+
+//requirePermission only lets requests through from users whose role carries perm, it
+//has to come after frontAuthHandler in the chain
+func requirePermission(perm string) func(http.Handler) http.Handler {
+	m := func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if isAPIKeyRequest(r) && !scopeAPIKey(r, perm) {
+				WriteError(w, ErrForbidden)
+				return
+			}
+			role, ok := roleget(r)
+			if !ok {
+				WriteError(w, ErrUnauthorized)
+				return
+			}
+			if !hasPermission(role, perm) || !apiKeyAllows(r, perm) {
+				WriteError(w, ErrForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		}
+
+		return http.HandlerFunc(fn)
+	}
+
+	return m
+}
+
+//requireScope is for routes anyone can use, signed in or not, that api keys can only
+//use if they were given perm. It has to come after frontAuthHandler in the chain
+func requireScope(perm string) func(http.Handler) http.Handler {
+	m := func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if isAPIKeyRequest(r) && !scopeAPIKey(r, perm) {
+				WriteError(w, ErrForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		}
+
+		return http.HandlerFunc(fn)
+	}
+
+	return m
+}
+
+//Handlers
+
+func (c *appContext) userRoleHandler(w http.ResponseWriter, r *http.Request) {
+	params := context.Get(r, "params").(httprouter.Params)
+	body := context.Get(r, "body").(*RoleRequest)
+	if _, ok := roleRank[body.Role]; !ok {
+		WriteError(w, ErrInvalidRole)
+		return
+	}
+
+	err := c.db.C("users").Update(bson.M{
+		"username": params.ByName("username"),
+	}, bson.M{
+		"$set": bson.M{"permission": body.Role},
+	})
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrNotFound)
+		return
+	}
+	// their tokens still carry the old role
+	err = c.revokeAllTokens(params.ByName("username"))
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(body)
+}
+
+//becomeProviderHandler lets a customer start listing skills. The sessions they have
+//carry the customer role, so they all end and this one gets new tokens
+func (c *appContext) becomeProviderHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := userget(r)
+	if err != nil || user.Username == "" {
+		WriteError(w, ErrUnauthorized)
+		return
+	}
+
+	err = c.db.C("users").Update(bson.M{
+		"username":   user.Username,
+		"permission": bson.M{"$in": []interface{}{RoleCustomer, "", nil}},
+	}, bson.M{
+		"$set": bson.M{"permission": RoleProvider},
+	})
+	if err == mgo.ErrNotFound {
+		WriteError(w, ErrAlreadyProvider)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	err = c.revokeAllTokens(user.Username)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	repo := UserRepo{c.db.C("users")}
+	userD, err := repo.Find(user.Username)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	c.writeTokenResponse(w, r, &userD.Data, "You can now list skills")
+}
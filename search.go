@@ -0,0 +1,487 @@
+package main
+
+import (
+	"encoding/json"
+	"html"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Skills are searched by the words in their name, summary, about, city and
+// state. Every query word has to match somewhere, either exactly, as the
+// start of a word ("plumb" finds "plumber") or within a couple of typos
+// ("plumbr" finds it too). Matches in the name count the most.
+const (
+	snippetContext = 40
+	snippetLength  = 160
+
+	// the most indexed words a query word is compared against to correct it
+	maxCorrectionCandidates = 1000
+)
+
+// how much a match in each field counts towards a skill's score
+var searchFields = []struct {
+	Name   string
+	Weight int
+}{
+	{"name", 10},
+	{"city", 5},
+	{"summary", 4},
+	{"state", 3},
+	{"about", 1},
+}
+
+//Searcher finds skills by free text. SkillRepo tells it about every skill it
+//creates, changes or deletes
+type Searcher interface {
+	Index(skill *Skill) error
+	Remove(id bson.ObjectId) error
+	Search(q string, page, perPage int) ([]SearchHit, int64, error)
+}
+
+//SearchHit is a skill that matched a search, with the matching part of each field
+//that matched, the words that matched wrapped in <em>
+type SearchHit struct {
+	Skill      Skill             `json:"skill"`
+	Score      float64           `json:"score"`
+	Highlights map[string]string `json:"highlights,omitempty"`
+}
+
+//SearchResults is a page of search hits
+type SearchResults struct {
+	Data []SearchHit `json:"data"`
+	Meta Page        `json:"meta"`
+}
+
+//Utility methods
+
+//searcherFromEnv picks the searcher based on the environment, SEARCH=memory keeps
+//the index in process, which is only any good for a single instance
+func searcherFromEnv(db *mgo.Database) Searcher {
+	if os.Getenv("SEARCH") == "memory" {
+		s := NewMemorySearcher()
+		iter := db.C("skills").Find(nil).Iter()
+		skill := Skill{}
+		for iter.Next(&skill) {
+			s.Index(&skill)
+			skill = Skill{}
+		}
+		if err := iter.Close(); err != nil {
+			log.Println(err)
+		}
+		return s
+	}
+
+	s := &MongoSearcher{skills: db.C("skills"), terms: db.C("searchterms")}
+	if err := s.EnsureIndexes(); err != nil {
+		log.Println(err)
+	}
+	return s
+}
+
+//searchTerms splits s into lower case words
+func searchTerms(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+//searchField is the text of the field called name in s
+func searchField(s *Skill, name string) string {
+	switch name {
+	case "name":
+		return s.Name
+	case "summary":
+		return s.Summary
+	case "about":
+		return s.About
+	case "city":
+		return s.City
+	case "state":
+		return s.State
+	}
+	return ""
+}
+
+//maxTypos is how many typos a query word of n letters may have, short words have to be exact
+func maxTypos(n int) int {
+	switch {
+	case n <= 3:
+		return 0
+	case n <= 6:
+		return 1
+	}
+	return 2
+}
+
+//editDistance is the number of single letter changes it takes to turn a into b
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+//matchTerm scores how well the query word term matches word: 1 for the same word,
+//less for a prefix of it and less again for a typo of it, 0 if it doesn't match
+func matchTerm(term, word string) float64 {
+	switch {
+	case term == word:
+		return 1
+	case len(term) >= 3 && strings.HasPrefix(word, term):
+		return 0.8
+	}
+	if n := len([]rune(term)); maxTypos(n) > 0 && editDistance(term, word) <= maxTypos(n) {
+		return 0.5
+	}
+	return 0
+}
+
+//highlight returns the part of text around the first word matching one of terms, every
+//matching word in it wrapped in <em>. The rest of the text is html escaped
+func highlight(text string, terms []string) (string, bool) {
+	type span struct{ start, end int }
+	rs := []rune(text)
+	matches := []span{}
+	start := -1
+	for i := 0; i <= len(rs); i++ {
+		if i < len(rs) && (unicode.IsLetter(rs[i]) || unicode.IsDigit(rs[i])) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start < 0 {
+			continue
+		}
+		word := strings.ToLower(string(rs[start:i]))
+		for _, t := range terms {
+			if matchTerm(t, word) > 0 {
+				matches = append(matches, span{start, i})
+				break
+			}
+		}
+		start = -1
+	}
+	if len(matches) == 0 {
+		return "", false
+	}
+
+	from := matches[0].start - snippetContext
+	if from < 0 {
+		from = 0
+	}
+	to := from + snippetLength
+	if to > len(rs) {
+		to = len(rs)
+	}
+
+	var b strings.Builder
+	if from > 0 {
+		b.WriteString("…")
+	}
+	pos := from
+	for _, m := range matches {
+		if m.end > to {
+			break
+		}
+		b.WriteString(html.EscapeString(string(rs[pos:m.start])))
+		b.WriteString("<em>" + html.EscapeString(string(rs[m.start:m.end])) + "</em>")
+		pos = m.end
+	}
+	b.WriteString(html.EscapeString(string(rs[pos:to])))
+	if to < len(rs) {
+		b.WriteString("…")
+	}
+	return b.String(), true
+}
+
+//highlights returns the snippet of every field of s that matches terms
+func highlights(s *Skill, terms []string) map[string]string {
+	result := map[string]string{}
+	for _, f := range searchFields {
+		if snippet, ok := highlight(searchField(s, f.Name), terms); ok {
+			result[f.Name] = snippet
+		}
+	}
+	return result
+}
+
+//MongoSearcher searches the skills collection through a mongo text index. Text indexes
+//only match whole words, so query words are first corrected against every word
+//ever indexed, kept in the terms collection
+type MongoSearcher struct {
+	skills *mgo.Collection
+	terms  *mgo.Collection
+}
+
+//EnsureIndexes creates the text index, weighted like the in process searcher
+func (s *MongoSearcher) EnsureIndexes() error {
+	key := []string{}
+	weights := map[string]int{}
+	for _, f := range searchFields {
+		key = append(key, "$text:"+f.Name)
+		weights[f.Name] = f.Weight
+	}
+	return s.skills.EnsureIndex(mgo.Index{
+		Key:     key,
+		Name:    "skills_text",
+		Weights: weights,
+	})
+}
+
+//Index adds the words of skill to the terms the query gets corrected against, the
+//text index itself mongo keeps up to date
+func (s *MongoSearcher) Index(skill *Skill) error {
+	seen := map[string]bool{}
+	for _, f := range searchFields {
+		for _, t := range searchTerms(searchField(skill, f.Name)) {
+			if seen[t] {
+				continue
+			}
+			seen[t] = true
+			_, err := s.terms.UpsertId(t, bson.M{"_id": t, "n": len([]rune(t))})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//Remove does nothing, mongo drops deleted skills from the text index. Their words stay
+//in the terms, which at worst corrects a query to a word nothing has anymore
+func (s *MongoSearcher) Remove(id bson.ObjectId) error {
+	return nil
+}
+
+//correct returns the indexed word that best matches term, or term if none do. Only
+//words starting with the same letter are considered, and of those only the ones term
+//starts or that are close enough in length to be a typo of it
+func (s *MongoSearcher) correct(term string) (string, error) {
+	words := []struct {
+		ID string `bson:"_id"`
+	}{}
+	first := string([]rune(term)[:1])
+	n := len([]rune(term))
+	err := s.terms.Find(bson.M{
+		"_id": bson.RegEx{Pattern: "^" + regexp.QuoteMeta(first)},
+		"$or": []bson.M{
+			{"n": bson.M{"$gte": n - maxTypos(n), "$lte": n + maxTypos(n)}},
+			{"_id": bson.RegEx{Pattern: "^" + regexp.QuoteMeta(term)}},
+			// words indexed before their length was kept
+			{"n": bson.M{"$exists": false}},
+		},
+	}).Limit(maxCorrectionCandidates).All(&words)
+	if err != nil {
+		return "", err
+	}
+
+	best, score := term, 0.0
+	for _, w := range words {
+		if m := matchTerm(term, w.ID); m > score || (m == score && m > 0 && len(w.ID) < len(best)) {
+			best, score = w.ID, m
+		}
+	}
+	return best, nil
+}
+
+//Search runs q against the text index, every corrected word has to be in a skill for
+//it to match
+func (s *MongoSearcher) Search(q string, page, perPage int) ([]SearchHit, int64, error) {
+	terms := searchTerms(q)
+	if len(terms) == 0 {
+		return []SearchHit{}, 0, nil
+	}
+	phrases := []string{}
+	for i, t := range terms {
+		corrected, err := s.correct(t)
+		if err != nil {
+			return nil, 0, err
+		}
+		terms[i] = corrected
+		// quoting every word makes mongo want all of them
+		phrases = append(phrases, `"`+corrected+`"`)
+	}
+
+	query := bson.M{"$text": bson.M{"$search": strings.Join(phrases, " ")}}
+	total, err := s.skills.Find(query).Count()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	found := []struct {
+		Skill `bson:",inline"`
+		Score float64 `bson:"score"`
+	}{}
+	err = s.skills.Find(query).
+		Select(bson.M{"score": bson.M{"$meta": "textScore"}}).
+		Sort("$textScore:score").
+		Skip((page - 1) * perPage).Limit(perPage).All(&found)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	hits := []SearchHit{}
+	for i := range found {
+		hits = append(hits, SearchHit{
+			Skill:      found[i].Skill,
+			Score:      found[i].Score,
+			Highlights: highlights(&found[i].Skill, terms),
+		})
+	}
+	return hits, int64(total), nil
+}
+
+//MemorySearcher keeps every skill in memory and scans them all on each search. It
+//needs no database, which makes it handy in tests and on a laptop
+type MemorySearcher struct {
+	mu     sync.RWMutex
+	skills map[bson.ObjectId]Skill
+}
+
+//NewMemorySearcher returns an empty MemorySearcher
+func NewMemorySearcher() *MemorySearcher {
+	return &MemorySearcher{skills: map[bson.ObjectId]Skill{}}
+}
+
+//Index adds skill, or replaces the copy of it already held
+func (s *MemorySearcher) Index(skill *Skill) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.skills[skill.ID] = *skill
+	return nil
+}
+
+//Remove forgets the skill with id
+func (s *MemorySearcher) Remove(id bson.ObjectId) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.skills, id)
+	return nil
+}
+
+//score is how well skill matches terms, or 0 if one of them matches nowhere
+func (s *MemorySearcher) score(skill *Skill, terms []string) float64 {
+	total := 0.0
+	for _, t := range terms {
+		best := 0.0
+		for _, f := range searchFields {
+			for _, word := range searchTerms(searchField(skill, f.Name)) {
+				if m := matchTerm(t, word) * float64(f.Weight); m > best {
+					best = m
+				}
+			}
+		}
+		if best == 0 {
+			return 0
+		}
+		total += best
+	}
+	return total
+}
+
+type byScore []SearchHit
+
+func (s byScore) Len() int      { return len(s) }
+func (s byScore) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byScore) Less(i, j int) bool {
+	if s[i].Score != s[j].Score {
+		return s[i].Score > s[j].Score
+	}
+	if !s[i].Skill.Timestamp.Equal(s[j].Skill.Timestamp) {
+		return s[i].Skill.Timestamp.After(s[j].Skill.Timestamp)
+	}
+	return s[i].Skill.ID > s[j].Skill.ID
+}
+
+//Search scores every skill against q, best first and newest first among equals
+func (s *MemorySearcher) Search(q string, page, perPage int) ([]SearchHit, int64, error) {
+	terms := searchTerms(q)
+	hits := []SearchHit{}
+	if len(terms) == 0 {
+		return hits, 0, nil
+	}
+
+	s.mu.RLock()
+	for _, skill := range s.skills {
+		if score := s.score(&skill, terms); score > 0 {
+			hits = append(hits, SearchHit{Skill: skill, Score: score})
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Sort(byScore(hits))
+
+	total := int64(len(hits))
+	start := (page - 1) * perPage
+	if start > len(hits) {
+		start = len(hits)
+	}
+	end := start + perPage
+	if end > len(hits) {
+		end = len(hits)
+	}
+	hits = hits[start:end]
+	for i := range hits {
+		hits[i].Highlights = highlights(&hits[i].Skill, terms)
+	}
+	return hits, total, nil
+}
+
+//Handlers
+
+//skillSearchHandler searches the catalog for ?q=, best matches first
+func (c *appContext) skillSearchHandler(w http.ResponseWriter, r *http.Request) {
+	page, perPage := pageget(r)
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q == "" || len(q) > maxQueryLength {
+		WriteError(w, ErrInvalidFilter)
+		return
+	}
+
+	hits, total, err := c.search.Search(q, page, perPage)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	for i := range hits {
+		hits[i].Skill.hideContact()
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	json.NewEncoder(w).Encode(SearchResults{
+		Data: hits,
+		Meta: Page{Page: page, PerPage: perPage, Total: total},
+	})
+}
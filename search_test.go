@@ -0,0 +1,134 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"plumber", "plumber", 0},
+		{"", "abc", 3},
+		{"abc", "", 3},
+		{"plumbr", "plumber", 1},
+		{"plumber", "plumbre", 2},
+		{"kitten", "sitting", 3},
+		{"café", "cafe", 1},
+	}
+	for _, tt := range tests {
+		if got := editDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestMatchTerm(t *testing.T) {
+	tests := []struct {
+		term, word string
+		want       float64
+	}{
+		{"plumber", "plumber", 1},
+		{"plumb", "plumber", 0.8},
+		{"pl", "plumber", 0},
+		{"plumbr", "plumber", 0.5},
+		{"electrcian", "electrician", 0.5},
+		{"elctrcian", "electrician", 0.5},
+		{"elctrcan", "electrician", 0},
+		{"cat", "car", 0},
+		{"hair", "chair", 0.5},
+		{"tailor", "plumber", 0},
+	}
+	for _, tt := range tests {
+		if got := matchTerm(tt.term, tt.word); got != tt.want {
+			t.Errorf("matchTerm(%q, %q) = %v, want %v", tt.term, tt.word, got, tt.want)
+		}
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	long := strings.Repeat("word ", 20) + "plumber " + strings.Repeat("word ", 40)
+
+	tests := []struct {
+		name  string
+		text  string
+		terms []string
+		want  string
+		found bool
+	}{
+		{"no match", "Licensed electrician", []string{"plumber"}, "", false},
+		{"exact", "Licensed plumber in Lagos", []string{"plumber"}, "Licensed <em>plumber</em> in Lagos", true},
+		{"every word", "Plumbing and plumbers", []string{"plumb"}, "<em>Plumbing</em> and <em>plumbers</em>", true},
+		{"typo", "Licensed plumber", []string{"plumbr"}, "Licensed <em>plumber</em>", true},
+		{"escaped", "<b>Pipes</b> & plumber", []string{"plumber"}, "&lt;b&gt;Pipes&lt;/b&gt; &amp; <em>plumber</em>", true},
+		{"trimmed", long, []string{"plumber"}, "…" + strings.Repeat("word ", 8) + "<em>plumber</em> " + strings.Repeat("word ", 23)[:112] + "…", true},
+	}
+	for _, tt := range tests {
+		got, found := highlight(tt.text, tt.terms)
+		if found != tt.found || got != tt.want {
+			t.Errorf("%s: highlight = %q, %v, want %q, %v", tt.name, got, found, tt.want, tt.found)
+		}
+	}
+}
+
+func TestMemorySearcher(t *testing.T) {
+	now := time.Now()
+	skills := []Skill{
+		{ID: bson.NewObjectId(), Name: "Plumber", Summary: "Leaks and pipes", City: "Lagos", Timestamp: now},
+		{ID: bson.NewObjectId(), Name: "Electrician", Summary: "Wiring, plumbing on the side", City: "Abuja", Timestamp: now.Add(-time.Hour)},
+		{ID: bson.NewObjectId(), Name: "Hair stylist", About: "Braids in Lagos", City: "Ibadan", Timestamp: now.Add(-2 * time.Hour)},
+	}
+	s := NewMemorySearcher()
+	for i := range skills {
+		s.Index(&skills[i])
+	}
+
+	tests := []struct {
+		q     string
+		names []string
+	}{
+		{"plumber", []string{"Plumber"}},
+		{"plumb", []string{"Plumber", "Electrician"}},
+		{"plumbr", []string{"Plumber"}},
+		{"lagos", []string{"Plumber", "Hair stylist"}},
+		{"plumber lagos", []string{"Plumber"}},
+		{"plumber abuja", []string{}},
+		{"carpenter", []string{}},
+		{"  ", []string{}},
+	}
+	for _, tt := range tests {
+		hits, total, err := s.Search(tt.q, 1, 10)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.q, err)
+		}
+		names := []string{}
+		for _, h := range hits {
+			names = append(names, h.Skill.Name)
+		}
+		if strings.Join(names, ",") != strings.Join(tt.names, ",") || total != int64(len(tt.names)) {
+			t.Errorf("Search(%q) = %v (%d), want %v", tt.q, names, total, tt.names)
+		}
+	}
+
+	hits, _, _ := s.Search("plumber", 1, 10)
+	if len(hits) != 1 || hits[0].Highlights["name"] != "<em>Plumber</em>" {
+		t.Errorf("Search(plumber) highlights = %v", hits)
+	}
+
+	hits, total, _ := s.Search("lagos", 2, 1)
+	if len(hits) != 1 || hits[0].Skill.Name != "Hair stylist" || total != 2 {
+		t.Errorf("Search(lagos) page 2 = %v (%d), want [Hair stylist] (2)", hits, total)
+	}
+
+	s.Remove(skills[0].ID)
+	hits, total, _ = s.Search("plumber", 1, 10)
+	if len(hits) != 0 || total != 0 {
+		t.Errorf("Search(plumber) after Remove = %v (%d), want nothing", hits, total)
+	}
+}
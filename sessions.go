@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/redis.v2"
+)
+
+var errSessionNotFound = errors.New("session not found")
+
+//Session is a signed in device. It lives as long as the refresh token family it
+//started with, and shares its id
+type Session struct {
+	ID        string    `json:"id"`
+	Username  string    `json:"-"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+	Created   time.Time `json:"created"`
+	LastSeen  time.Time `json:"last_seen"`
+	Current   bool      `json:"current"`
+}
+
+//SessionsCollection holds a slice of sessions under the key "data"
+type SessionsCollection struct {
+	Data []Session `json:"data"`
+}
+
+//Utility methods
+
+//newSession describes the device r came from, the id is set once the session is stored
+func newSession(r *http.Request, username string) *Session {
+	return &Session{
+		Username:  username,
+		UserAgent: r.UserAgent(),
+		IP:        clientIP(r),
+		Created:   time.Now(),
+	}
+}
+
+var touchSessionRedisScript = redis.NewScript(`
+	if redis.call("exists", "sessions:"..KEYS[1]) == 0 then
+		return 0
+	end
+	redis.call("set", "sessions:"..KEYS[1]..":seen", ARGV[1], "EX", ARGV[2])
+	return 1
+`)
+
+//touchSession marks session sid as seen just now, it returns false if the session is gone
+func (c *appContext) touchSession(sid string) (bool, error) {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	ttl := strconv.FormatInt(int64(RefreshTokenTTL/time.Second), 10)
+	resp, err := touchSessionRedisScript.Run(c.redis, []string{sid}, []string{now, ttl}).Result()
+	if err != nil {
+		return false, err
+	}
+	return resp.(int64) == 1, nil
+}
+
+// returns {id, session, last seen} for every live session of the user, and
+// forgets the ones that expired on their own
+var listSessionsRedisScript = redis.NewScript(`
+	local key = "users:"..KEYS[1]..":refresh"
+	local ids = redis.call("smembers", key)
+	local result = {}
+	for i=1,#ids do
+		local s = redis.call("get", "sessions:"..ids[i])
+		if s then
+			local seen = redis.call("get", "sessions:"..ids[i]..":seen") or ""
+			table.insert(result, {ids[i], s, seen})
+		else
+			redis.call("srem", key, ids[i])
+		end
+	end
+	return result
+`)
+
+//listSessions returns the live sessions of username
+func (c *appContext) listSessions(username string) ([]Session, error) {
+	resp, err := listSessionsRedisScript.Run(c.redis, []string{username}, []string{}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []Session{}
+	for _, rr := range resp.([]interface{}) {
+		fields := rr.([]interface{})
+		s := Session{}
+		err = json.Unmarshal([]byte(fields[1].(string)), &s)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		s.ID = fields[0].(string)
+		s.LastSeen = s.Created
+		if seen, err := strconv.ParseInt(fields[2].(string), 10, 64); err == nil {
+			s.LastSeen = time.Unix(seen, 0)
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, nil
+}
+
+var revokeSessionRedisScript = redis.NewScript(`
+	if redis.call("srem", "users:"..KEYS[1]..":refresh", KEYS[2]) == 0 then
+		return 0
+	end
+	redis.call("del", "refresh:family:"..KEYS[2], "sessions:"..KEYS[2], "sessions:"..KEYS[2]..":seen")
+	return 1
+`)
+
+//revokeSession signs username out of session sid, killing its refresh tokens and the
+//access tokens issued in it
+func (c *appContext) revokeSession(username, sid string) error {
+	resp, err := revokeSessionRedisScript.Run(c.redis, []string{username, sid}, []string{}).Result()
+	if err != nil {
+		return err
+	}
+	if resp.(int64) != 1 {
+		return errSessionNotFound
+	}
+	return nil
+}
+
+//Handlers
+
+func (c *appContext) sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := userget(r)
+	if err != nil || user.Username == "" {
+		WriteError(w, ErrUnauthorized)
+		return
+	}
+
+	sessions, err := c.listSessions(user.Username)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	current, _ := claimsget(r)["sid"].(string)
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == current
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	json.NewEncoder(w).Encode(SessionsCollection{sessions})
+}
+
+func (c *appContext) deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	params := context.Get(r, "params").(httprouter.Params)
+	user, err := userget(r)
+	if err != nil || user.Username == "" {
+		WriteError(w, ErrUnauthorized)
+		return
+	}
+
+	err = c.revokeSession(user.Username, params.ByName("id"))
+	if err == errSessionNotFound {
+		WriteError(w, ErrNotFound)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//deleteOtherSessionsHandler signs the user out everywhere except where this request came from
+func (c *appContext) deleteOtherSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := userget(r)
+	if err != nil || user.Username == "" {
+		WriteError(w, ErrUnauthorized)
+		return
+	}
+
+	sessions, err := c.listSessions(user.Username)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	current, _ := claimsget(r)["sid"].(string)
+	for _, s := range sessions {
+		if s.ID == current {
+			continue
+		}
+		err = c.revokeSession(user.Username, s.ID)
+		if err != nil && err != errSessionNotFound {
+			log.Println(err)
+			WriteError(w, ErrInternalServer)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/extemporalgenome/slug"
@@ -17,22 +18,26 @@ import (
 
 // Skill struct holds information about each users skills, aids in marshalling to json and storing on the database
 type Skill struct {
-	ID           bson.ObjectId `json:"id,omitempty" bson:"_id,omitempty"`
-	Featured     int           `json:"featured,omitempty"`
-	Slug         string        `json:"slug"`
-	Name         string        `json:"name"`
-	Summary      string        `json:"summary"`
-	About        string        `json:"about"`
-	Address      string        `json:"address"`
-	City         string        `json:"city"`
-	State        string        `json:"state"`
-	Phone        string        `json:"phone"`
-	Owner        string        `json:"owner"`
-	Timestamp    time.Time     `json:"timestamp"`
-	Images       []Images      `json:"images"`
-	Rating       int           `json:"rating"`
-	TotalReviews int           `json:"-"`
-	ReviewsCount int           `json:"-"`
+	ID            bson.ObjectId `json:"id,omitempty" bson:"_id,omitempty"`
+	Featured      int           `json:"featured,omitempty"`
+	Slug          string        `json:"slug"`
+	Name          string        `json:"name"`
+	Summary       string        `json:"summary"`
+	About         string        `json:"about"`
+	Address       string        `json:"address"`
+	City          string        `json:"city"`
+	State         string        `json:"state"`
+	Category      string        `json:"category"`
+	Location      *GeoPoint     `json:"location,omitempty" bson:"location,omitempty"`
+	Distance      float64       `json:"distance,omitempty" bson:"-"`
+	ServiceRadius float64       `json:"service_radius,omitempty" bson:"serviceradius,omitempty"`
+	Phone         string        `json:"phone"`
+	Owner         string        `json:"owner"`
+	Timestamp     time.Time     `json:"timestamp"`
+	Images        []Images      `json:"images"`
+	Rating        int           `json:"rating"`
+	TotalReviews  int           `json:"-"`
+	ReviewsCount  int           `json:"reviews_count"`
 }
 
 //SkillsCollection holds a slice of Skill structs within a Data key, to conform with the json api schema spec
@@ -45,9 +50,11 @@ type SkillResource struct {
 	Data Skill `json:"data"`
 }
 
-//SkillRepo a mongo Collection that could get passed around
+//SkillRepo a mongo Collection that could get passed around, along with the searcher
+//that has to hear about every change to it
 type SkillRepo struct {
-	coll *mgo.Collection
+	coll   *mgo.Collection
+	search Searcher
 }
 
 //Utility methods
@@ -92,20 +99,49 @@ func (r *SkillRepo) Create(skill *Skill) error {
 	}
 
 	skill.ID = id
+	r.index(skill)
 
 	return nil
 }
 
 //Update updates information about a skill
 func (r *SkillRepo) Update(skill *Skill) error {
-	log.Println(skill)
+	// only the fields an edit can change are set, images, ratings and counts
+	// have their own updates that could be running at the same time
+	set := bson.M{
+		"featured": skill.Featured,
+		"name":     skill.Name,
+		"summary":  skill.Summary,
+		"about":    skill.About,
+		"address":  skill.Address,
+		"city":     skill.City,
+		"state":    skill.State,
+		"category": skill.Category,
+		"phone":    skill.Phone,
+	}
+	unset := bson.M{}
+	if skill.Location != nil {
+		set["location"] = skill.Location
+	} else {
+		unset["location"] = ""
+	}
+	if skill.ServiceRadius != 0 {
+		set["serviceradius"] = skill.ServiceRadius
+	} else {
+		unset["serviceradius"] = ""
+	}
+	update := bson.M{"$set": set}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
 	err := r.coll.Update(
 		bson.M{
 			"slug": skill.Slug,
-		}, skill)
+		}, update)
 	if err != nil {
 		return err
 	}
+	r.index(skill)
 
 	return nil
 }
@@ -116,18 +152,102 @@ func (r *SkillRepo) Delete(id string) error {
 	if err != nil {
 		return err
 	}
+	r.unindex(bson.ObjectIdHex(id))
 
 	return nil
 }
 
+//DeleteOwner removes every skill owner has, and returns their ids and images
+func (r *SkillRepo) DeleteOwner(owner string) ([]Skill, error) {
+	owned := []Skill{}
+	err := r.coll.Find(bson.M{"owner": owner}).Select(bson.M{"_id": 1, "images": 1}).All(&owned)
+	if err != nil {
+		return nil, err
+	}
+	_, err = r.coll.RemoveAll(bson.M{"owner": owner})
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range owned {
+		r.unindex(s.ID)
+	}
+
+	return owned, nil
+}
+
+// the skill is saved by the time the searcher hears about it, so a search
+// index falling behind is logged rather than failing the request
+func (r *SkillRepo) index(skill *Skill) {
+	if r.search == nil {
+		return
+	}
+	if err := r.search.Index(skill); err != nil {
+		log.Println(err)
+	}
+}
+
+func (r *SkillRepo) unindex(id bson.ObjectId) {
+	if r.search == nil {
+		return
+	}
+	if err := r.search.Remove(id); err != nil {
+		log.Println(err)
+	}
+}
+
+//canEditSkill reports whether the user the request was authenticated as may change
+//skill, which is true for its owner and for moderators
+func canEditSkill(r *http.Request, skill *Skill) bool {
+	user, err := userget(r)
+	if err != nil || user.Username == "" {
+		return false
+	}
+	if skill.Owner == user.Username {
+		return true
+	}
+	role, _ := roleget(r)
+	return hasPermission(role, PermSkillsModerate)
+}
+
+//ownedSkill loads the skill a mutation request is about and checks the caller may change
+//it, writing the error response and returning false if not
+func (c *appContext) ownedSkill(w http.ResponseWriter, r *http.Request, slug string) (*Skill, bool) {
+	repo := SkillRepo{c.db.C("skills"), c.search}
+	skill, err := repo.Find(slug)
+	if err == mgo.ErrNotFound {
+		WriteError(w, ErrNotFound)
+		return nil, false
+	}
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return nil, false
+	}
+
+	if !canEditSkill(r, &skill.Data) {
+		WriteError(w, ErrForbidden)
+		return nil, false
+	}
+
+	return &skill.Data, true
+}
+
 //Handlers
-func (c *appContext) skillsHandler(w http.ResponseWriter, r *http.Request) {
-	repo := SkillRepo{c.db.C("skills")}
-	user, _ := userget(r)
-	log.Println(user)
+
+//mySkillsHandler lists every skill the user owns, contact details and all
+func (c *appContext) mySkillsHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := userget(r)
+	if err != nil || user.Username == "" {
+		WriteError(w, ErrUnauthorized)
+		return
+	}
+
+	repo := SkillRepo{c.db.C("skills"), c.search}
 	skills, err := repo.All(user.Username)
 	if err != nil {
-		panic(err)
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/vnd.api+json")
@@ -136,13 +256,12 @@ func (c *appContext) skillsHandler(w http.ResponseWriter, r *http.Request) {
 
 func (c *appContext) skillHandler(w http.ResponseWriter, r *http.Request) {
 	params := context.Get(r, "params").(httprouter.Params)
-	repo := SkillRepo{c.db.C("skills")}
+	repo := SkillRepo{c.db.C("skills"), c.search}
 	skill, err := repo.Find(params.ByName("slug"))
 	if err != nil {
 		panic(err)
 	}
-	skill.Data.Phone = ""
-	skill.Data.Address = "hidden"
+	skill.Data.hideContact()
 
 	w.Header().Set("Content-Type", "application/vnd.api+json")
 	json.NewEncoder(w).Encode(skill)
@@ -150,8 +269,42 @@ func (c *appContext) skillHandler(w http.ResponseWriter, r *http.Request) {
 
 func (c *appContext) createSkillHandler(w http.ResponseWriter, r *http.Request) {
 	body := context.Get(r, "body").(*SkillResource)
-	repo := SkillRepo{c.db.C("skills")}
-	err := repo.Create(&body.Data)
+	user, err := userget(r)
+	if err != nil || user.Username == "" {
+		WriteError(w, ErrUnauthorized)
+		return
+	}
+
+	// a skill always belongs to whoever created it, and starts with no reviews
+	body.Data.Owner = user.Username
+	body.Data.Timestamp = time.Now()
+	body.Data.Rating = 0
+	body.Data.TotalReviews = 0
+	body.Data.ReviewsCount = 0
+	body.Data.Images = []Images{}
+	// only moderators pick what gets featured
+	role, _ := roleget(r)
+	if !hasPermission(role, PermSkillsModerate) {
+		body.Data.Featured = 0
+	}
+	body.Data.Category = strings.ToLower(strings.TrimSpace(body.Data.Category))
+	ok, err := c.validCategory(body.Data.Category)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	if !ok {
+		WriteError(w, ErrInvalidCategory)
+		return
+	}
+	if !validLocation(&body.Data) {
+		WriteError(w, ErrInvalidLocation)
+		return
+	}
+
+	repo := SkillRepo{c.db.C("skills"), c.search}
+	err = repo.Create(&body.Data)
 	if err != nil {
 		log.Println(err)
 	}
@@ -164,9 +317,44 @@ func (c *appContext) createSkillHandler(w http.ResponseWriter, r *http.Request)
 func (c *appContext) updateSkillHandler(w http.ResponseWriter, r *http.Request) {
 	params := context.Get(r, "params").(httprouter.Params)
 	body := context.Get(r, "body").(*SkillResource)
-	body.Data.Slug = params.ByName("slug")
-	repo := SkillRepo{c.db.C("skills")}
-	err := repo.Update(&body.Data)
+	skill, ok := c.ownedSkill(w, r, params.ByName("slug"))
+	if !ok {
+		return
+	}
+
+	// none of these are the client's to change, not even a moderator's
+	body.Data.ID = skill.ID
+	body.Data.Slug = skill.Slug
+	body.Data.Owner = skill.Owner
+	body.Data.Timestamp = skill.Timestamp
+	body.Data.Rating = skill.Rating
+	body.Data.TotalReviews = skill.TotalReviews
+	body.Data.ReviewsCount = skill.ReviewsCount
+	body.Data.Images = skill.Images
+	body.Data.Category = strings.ToLower(strings.TrimSpace(body.Data.Category))
+	ok, err := c.validCategory(body.Data.Category)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	// a category the tree doesn't know can stay, as long as the skill isn't
+	// moving to it
+	if !ok && body.Data.Category != skill.Category {
+		WriteError(w, ErrInvalidCategory)
+		return
+	}
+	if !validLocation(&body.Data) {
+		WriteError(w, ErrInvalidLocation)
+		return
+	}
+	role, _ := roleget(r)
+	if !hasPermission(role, PermSkillsModerate) {
+		body.Data.Featured = skill.Featured
+	}
+
+	repo := SkillRepo{c.db.C("skills"), c.search}
+	err = repo.Update(&body.Data)
 	if err != nil {
 		log.Println(err)
 	}
@@ -179,11 +367,17 @@ func (c *appContext) updateSkillHandler(w http.ResponseWriter, r *http.Request)
 
 func (c *appContext) deleteSkillHandler(w http.ResponseWriter, r *http.Request) {
 	params := context.Get(r, "params").(httprouter.Params)
-	repo := SkillRepo{c.db.C("skills")}
-	err := repo.Delete(params.ByName("slug"))
+	skill, ok := c.ownedSkill(w, r, params.ByName("slug"))
+	if !ok {
+		return
+	}
+
+	repo := SkillRepo{c.db.C("skills"), c.search}
+	err := repo.Delete(skill.ID.Hex())
 	if err != nil {
 		panic(err)
 	}
+	c.deleteImages(skill.Images...)
 
 	w.WriteHeader(http.StatusNoContent)
 	w.Write([]byte("\n"))
@@ -191,7 +385,7 @@ func (c *appContext) deleteSkillHandler(w http.ResponseWriter, r *http.Request)
 
 func (c *appContext) getSkillContact(w http.ResponseWriter, r *http.Request) {
 	params := context.Get(r, "params").(httprouter.Params)
-	repo := SkillRepo{c.db.C("skills")}
+	repo := SkillRepo{c.db.C("skills"), c.search}
 	skill, err := repo.Find(params.ByName("slug"))
 	if err != nil {
 		panic(err)
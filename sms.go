@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+//SMSSender is anything that can get a text message to a phone. Numbers are always
+//in E.164 form by the time they get here
+type SMSSender interface {
+	Send(to, body string) error
+}
+
+//FileSMSSender appends every text it is asked to send to a file, or to the log
+//when Path is empty
+type FileSMSSender struct {
+	Path string
+	mu   sync.Mutex
+}
+
+//Send writes the text out instead of sending it
+func (s *FileSMSSender) Send(to, body string) error {
+	msg := fmt.Sprintf("Date: %s\nTo: %s\n\n%s\n\n", time.Now().Format(time.RFC1123Z), to, body)
+	if s.Path == "" {
+		log.Print(msg)
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(msg)
+	return err
+}
+
+//smsSenderFromEnv picks an sms sender based on the environment. There is no real
+//gateway yet, so texts go to SMSFILE (or the log)
+func smsSenderFromEnv() SMSSender {
+	log.Println("Text messages would be written to SMSFILE or the log")
+	return &FileSMSSender{Path: os.Getenv("SMSFILE")}
+}
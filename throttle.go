@@ -0,0 +1,175 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/redis.v2"
+)
+
+const (
+	//LoginFailureWindow is how long a failed sign in is remembered for
+	LoginFailureWindow = time.Minute * 15
+
+	//LoginFreeAttempts is how many failures in a row are let through before backing off
+	LoginFreeAttempts = 3
+
+	//LoginMaxBackoff caps how long a client has to wait between attempts
+	LoginMaxBackoff = time.Minute * 5
+
+	//LoginLockoutAttempts is how many failures in the window lock an account
+	LoginLockoutAttempts = 10
+
+	//LoginLockoutDuration is how long a locked account stays locked, unless an admin unlocks it
+	LoginLockoutDuration = time.Minute * 30
+)
+
+//LockoutNotifier gets told whenever an account is locked after too many failed sign ins
+type LockoutNotifier interface {
+	AccountLocked(user *User, ip string, until time.Time)
+}
+
+//mailLockoutNotifier tells the owner of the account by email
+type mailLockoutNotifier struct {
+	mailer Mailer
+}
+
+//AccountLocked mails user about the lock
+func (n *mailLockoutNotifier) AccountLocked(user *User, ip string, until time.Time) {
+	body := "Hi " + user.Name + ",\n\n" +
+		"There were too many failed attempts to sign in to your oddjobz account, the last one from " + ip + ". " +
+		"To keep it safe, sign in is disabled until " + until.Format(time.RFC1123) + ".\n\n" +
+		"If this wasn't you, consider resetting your password once the lock is over."
+
+	err := n.mailer.Send(user.Email, "Your oddjobz account has been locked", body)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+//Utility methods
+
+// returns {state, seconds}: 1 when the account is locked, 2 when the client
+// has to back off, 0 when it may try
+var loginThrottleRedisScript = redis.NewScript(`
+	local locked = redis.call("ttl", KEYS[1]..":locked")
+	if locked > 0 then
+		return {1, locked}
+	end
+
+	local wait = math.max(redis.call("ttl", KEYS[1]..":wait"), redis.call("ttl", KEYS[2]..":wait"))
+	if wait > 0 then
+		return {2, wait}
+	end
+	return {0, 0}
+`)
+
+// every failure past the free ones doubles the wait, on both the account and
+// the ip, and enough of them on the account locks it. returns 1 when this
+// failure locked the account.
+var loginFailedRedisScript = redis.NewScript(`
+	local function fail(key)
+		local n = redis.call("incr", key..":fails")
+		redis.call("expire", key..":fails", ARGV[1])
+
+		local over = n - tonumber(ARGV[2])
+		if over > 0 then
+			redis.call("set", key..":wait", "1", "EX", math.min(2 ^ over, tonumber(ARGV[3])))
+		end
+		return n
+	end
+
+	local n = fail(KEYS[1])
+	fail(KEYS[2])
+
+	if n >= tonumber(ARGV[4]) then
+		redis.call("set", KEYS[1]..":locked", "1", "EX", ARGV[5])
+		redis.call("del", KEYS[1]..":fails", KEYS[1]..":wait")
+		return 1
+	end
+	return 0
+`)
+
+func loginKeys(email, ip string) []string {
+	return []string{"login:user:" + email, "login:ip:" + ip}
+}
+
+func seconds(d time.Duration) string {
+	return strconv.FormatInt(int64(d/time.Second), 10)
+}
+
+//loginThrottled checks if a sign in for email from ip may go ahead. It returns how long
+//the client has to wait, and whether that's because the account is locked
+func (c *appContext) loginThrottled(email, ip string) (time.Duration, bool, error) {
+	resp, err := loginThrottleRedisScript.Run(c.redis, loginKeys(email, ip), []string{}).Result()
+	if err != nil {
+		return 0, false, err
+	}
+
+	result := resp.([]interface{})
+	wait := time.Duration(result[1].(int64)) * time.Second
+	return wait, result[0].(int64) == 1, nil
+}
+
+//loginFailed records a failed sign in for email from ip, user is nil when no account has that email
+func (c *appContext) loginFailed(email, ip string, user *User) {
+	resp, err := loginFailedRedisScript.Run(c.redis, loginKeys(email, ip), []string{
+		seconds(LoginFailureWindow),
+		strconv.Itoa(LoginFreeAttempts),
+		seconds(LoginMaxBackoff),
+		strconv.Itoa(LoginLockoutAttempts),
+		seconds(LoginLockoutDuration),
+	}).Result()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if resp.(int64) == 1 {
+		log.Printf("account %s locked after failed sign ins, last from %s\n", email, ip)
+		if user != nil && c.lockoutNotifier != nil {
+			go c.lockoutNotifier.AccountLocked(user, ip, time.Now().Add(LoginLockoutDuration))
+		}
+	}
+}
+
+//loginSucceeded forgets the failures against email, the ones against the ip stay
+func (c *appContext) loginSucceeded(email string) {
+	key := "login:user:" + email
+	err := c.redis.Del(key+":fails", key+":wait").Err()
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+//unlockAccount lifts a lock on email and forgets its failures
+func (c *appContext) unlockAccount(email string) error {
+	key := "login:user:" + email
+	return c.redis.Del(key+":fails", key+":wait", key+":locked").Err()
+}
+
+//Handlers
+
+func (c *appContext) unlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	params := context.Get(r, "params").(httprouter.Params)
+	repo := UserRepo{c.db.C("users")}
+	user, err := repo.Find(params.ByName("username"))
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrNotFound)
+		return
+	}
+
+	err = c.unlockAccount(user.Data.Email)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/context"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/redis.v2"
+)
+
+const (
+	//AccessTokenTTL is how long a signed JWT is usable. It is kept short since
+	//the only way to kill one before then is the revocation list
+	AccessTokenTTL = time.Minute * 15
+
+	//RefreshTokenTTL is how long a refresh token lives if it is never used,
+	//every rotation starts the clock again
+	RefreshTokenTTL = time.Hour * 24 * 30
+)
+
+var (
+	errRefreshTokenInvalid = errors.New("refresh token is invalid or expired")
+	errRefreshTokenReused  = errors.New("refresh token reused, family revoked")
+	errPurposeTokenInvalid = errors.New("token is invalid or has already been used")
+)
+
+//refreshRecord is what gets stored in redis against every refresh token we hand out.
+//Every token minted from the same login shares a Family
+type refreshRecord struct {
+	Family   string `json:"family"`
+	Username string `json:"username"`
+}
+
+//TokenRequest is the body expected by the refresh and logout endpoints
+type TokenRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+//TokenResponse is what a successful sign in or refresh sends back
+type TokenResponse struct {
+	User         SelfUser `json:"user"`
+	Message      string   `json:"message"`
+	Token        string   `json:"token"`
+	RefreshToken string   `json:"refresh_token,omitempty"`
+}
+
+//signToken creates a short lived access token for user within session sid, every token gets
+//its own id (jti) so it can be revoked on its own
+func (c *appContext) signToken(user *User, sid string) (string, error) {
+	// create a signer for rsa 256
+	t := jwt.New(jwt.GetSigningMethod("RS256"))
+
+	// set our claims
+	t.Claims["AccessToken"] = user.Permission
+	t.Claims["User"] = selfUser(user)
+	t.Claims["jti"] = bson.NewObjectId().Hex()
+	t.Claims["iat"] = time.Now().Unix()
+	t.Claims["sid"] = sid
+
+	// set the expire time
+	// see http://tools.ietf.org/html/draft-ietf-oauth-json-web-token-20#section-4.1.4
+	t.Claims["exp"] = time.Now().Add(AccessTokenTTL).Unix()
+	return c.sign(t)
+}
+
+//sign signs t with the active key, and says which one it was in the "kid" header
+func (c *appContext) sign(t *jwt.Token) (string, error) {
+	key := c.keys.Signer()
+	if key == nil {
+		return "", errNoSigningKey
+	}
+	t.Header["kid"] = key.ID
+	return t.SignedString(key.Private)
+}
+
+// a refresh token family is a session: they share an id and die together
+var newRefreshRedisScript = redis.NewScript(`
+	redis.call("set", "refresh:"..KEYS[1], ARGV[1], "EX", ARGV[3])
+	redis.call("set", "refresh:family:"..ARGV[2], KEYS[1], "EX", ARGV[3])
+	redis.call("set", "sessions:"..ARGV[2], ARGV[5], "EX", ARGV[3])
+	redis.call("sadd", "users:"..ARGV[4]..":refresh", ARGV[2])
+	return 1
+`)
+
+//newRefreshToken starts a new refresh token family for session and returns its first token
+func (c *appContext) newRefreshToken(session *Session) (string, error) {
+	token, err := randToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	session.ID = bson.NewObjectId().Hex()
+	record := refreshRecord{
+		Family:   session.ID,
+		Username: session.Username,
+	}
+	x, err := json.Marshal(record)
+	if err != nil {
+		return "", err
+	}
+	s, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+
+	ttl := strconv.FormatInt(int64(RefreshTokenTTL/time.Second), 10)
+	err = newRefreshRedisScript.Run(c.redis, []string{hashToken(token)}, []string{string(x), record.Family, ttl, session.Username, string(s)}).Err()
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// the family key always points at the only token in the family that may
+// still be used. presenting any other token from the family means it was
+// stolen (or replayed) so the whole family dies.
+var rotateRefreshRedisScript = redis.NewScript(`
+	local rec = redis.call("get", "refresh:"..KEYS[1])
+	if not rec then
+		return {0, ""}
+	end
+
+	local family = cjson.decode(rec)["family"]
+	if redis.call("get", "refresh:family:"..family) ~= KEYS[1] then
+		redis.call("del", "refresh:family:"..family, "sessions:"..family)
+		return {-1, rec}
+	end
+
+	redis.call("set", "refresh:"..KEYS[2], rec, "EX", ARGV[1])
+	redis.call("set", "refresh:family:"..family, KEYS[2], "EX", ARGV[1])
+	redis.call("expire", "sessions:"..family, ARGV[1])
+	return {1, rec}
+`)
+
+//rotateRefreshToken swaps token for a new one in the same family, it returns the
+//record the old token was stored with
+func (c *appContext) rotateRefreshToken(token string) (string, *refreshRecord, error) {
+	newToken, err := randToken(32)
+	if err != nil {
+		return "", nil, err
+	}
+
+	ttl := strconv.FormatInt(int64(RefreshTokenTTL/time.Second), 10)
+	resp, err := rotateRefreshRedisScript.Run(c.redis, []string{hashToken(token), hashToken(newToken)}, []string{ttl}).Result()
+	if err != nil {
+		return "", nil, err
+	}
+
+	result := resp.([]interface{})
+	record := &refreshRecord{}
+	if rec, ok := result[1].(string); ok && rec != "" {
+		err = json.Unmarshal([]byte(rec), record)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	switch result[0].(int64) {
+	case 1:
+		return newToken, record, nil
+	case -1:
+		log.Printf("refresh token reuse for %s, family %s revoked\n", record.Username, record.Family)
+		return "", record, errRefreshTokenReused
+	default:
+		return "", nil, errRefreshTokenInvalid
+	}
+}
+
+//revokeRefreshToken kills the family token belongs to, as long as it belongs to username
+func (c *appContext) revokeRefreshToken(token, username string) error {
+	rec, err := c.redis.Get("refresh:" + hashToken(token)).Result()
+	if err == redis.Nil {
+		return errRefreshTokenInvalid
+	}
+	if err != nil {
+		return err
+	}
+
+	record := refreshRecord{}
+	err = json.Unmarshal([]byte(rec), &record)
+	if err != nil {
+		return err
+	}
+	if record.Username != username {
+		return errRefreshTokenInvalid
+	}
+
+	return c.revokeSession(username, record.Family)
+}
+
+//revokeToken adds an access token id to the revocation list, it only needs to
+//stay there until the token would have expired anyway
+func (c *appContext) revokeToken(jti string, exp int64) error {
+	ttl := time.Unix(exp, 0).Sub(time.Now())
+	if ttl <= 0 {
+		return nil
+	}
+	return c.setex("tokens:revoked:"+jti, "1", ttl)
+}
+
+//isTokenRevoked checks the revocation list for the id of an access token, and
+//whether its user revoked every token issued before a point in time
+func (c *appContext) isTokenRevoked(claims map[string]interface{}) (bool, error) {
+	if jti, ok := claims["jti"].(string); ok {
+		revoked, err := c.redis.Exists("tokens:revoked:" + jti).Result()
+		if err != nil || revoked {
+			return revoked, err
+		}
+	}
+
+	// a token dies with the session it was issued in
+	if sid, ok := claims["sid"].(string); ok && sid != "" {
+		live, err := c.touchSession(sid)
+		if err != nil || !live {
+			return !live, err
+		}
+	}
+
+	user, _ := claims["User"].(map[string]interface{})
+	username, _ := user["username"].(string)
+	iat, _ := claims["iat"].(float64)
+	if username == "" {
+		return false, nil
+	}
+
+	after, err := c.redis.Get("users:" + username + ":tokens-after").Result()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	since, err := strconv.ParseInt(after, 10, 64)
+	if err != nil {
+		return false, err
+	}
+	return int64(iat) < since, nil
+}
+
+var revokeAllRedisScript = redis.NewScript(`
+	local families = redis.call("smembers", "users:"..KEYS[1]..":refresh")
+	for i=1,#families do
+		redis.call("del", "refresh:family:"..families[i], "sessions:"..families[i], "sessions:"..families[i]..":seen")
+	end
+	redis.call("del", "users:"..KEYS[1]..":refresh")
+	redis.call("set", "users:"..KEYS[1]..":tokens-after", ARGV[1], "EX", ARGV[2])
+	return #families
+`)
+
+//revokeAllTokens kills every refresh token family of username and every access
+//token issued to them until now
+func (c *appContext) revokeAllTokens(username string) error {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	ttl := strconv.FormatInt(int64(AccessTokenTTL/time.Second), 10)
+	return revokeAllRedisScript.Run(c.redis, []string{username}, []string{now, ttl}).Err()
+}
+
+//claimsget returns the claims of the token the current request was authenticated with
+func claimsget(r *http.Request) map[string]interface{} {
+	claims, ok := context.Get(r, "Claims").(map[string]interface{})
+	if !ok {
+		return map[string]interface{}{}
+	}
+	return claims
+}
+
+//writeTokenResponse starts a new session for user, signs an access token and the first
+//refresh token of the session, then sends both back the same way authHandler always has
+func (c *appContext) writeTokenResponse(w http.ResponseWriter, r *http.Request, user *User, message string) {
+	session := newSession(r, user.Username)
+	refreshToken, err := c.newRefreshToken(session)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	tokenString, err := c.signToken(user, session.ID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "Sorry, error while Signing Token!")
+		log.Printf("Token Signing error: %v\n", err)
+		return
+	}
+
+	c.writeTokens(w, user, message, tokenString, refreshToken)
+}
+
+func (c *appContext) writeTokens(w http.ResponseWriter, user *User, message, tokenString, refreshToken string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:       c.token,
+		Value:      tokenString,
+		Path:       "/",
+		RawExpires: "0",
+	})
+
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(TokenResponse{
+		User:         selfUser(user),
+		Message:      message,
+		Token:        tokenString,
+		RefreshToken: refreshToken,
+	})
+}
+
+//keyFunc hands jwt.Parse the key to check a token against, refusing anything
+//not signed the way we sign
+func (c *appContext) keyFunc(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	// any key still on the ring will do, so tokens signed
+	// before a rotation live out their lifetime
+	kid, _ := token.Header["kid"].(string)
+	return c.keys.Public(kid)
+}
+
+//signPurposeToken signs a single use token that is only good for purpose (verifying
+//an email and the likes). It can never be used as an access token
+func (c *appContext) signPurposeToken(purpose string, claims map[string]interface{}, ttl time.Duration) (string, error) {
+	t := jwt.New(jwt.GetSigningMethod("RS256"))
+	for k, v := range claims {
+		t.Claims[k] = v
+	}
+	jti := bson.NewObjectId().Hex()
+	t.Claims["purpose"] = purpose
+	t.Claims["jti"] = jti
+	t.Claims["exp"] = time.Now().Add(ttl).Unix()
+
+	tokenString, err := c.sign(t)
+	if err != nil {
+		return "", err
+	}
+
+	err = c.setex("tokens:"+purpose+":"+jti, "1", ttl)
+	if err != nil {
+		return "", err
+	}
+	return tokenString, nil
+}
+
+//parsePurposeToken validates a token made by signPurposeToken without using it up
+func (c *appContext) parsePurposeToken(purpose, tokenString string) (map[string]interface{}, error) {
+	token, err := jwt.Parse(tokenString, c.keyFunc)
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid || token.Claims["purpose"] != purpose {
+		return nil, errPurposeTokenInvalid
+	}
+
+	jti, _ := token.Claims["jti"].(string)
+	live, err := c.redis.Exists("tokens:" + purpose + ":" + jti).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !live {
+		return nil, errPurposeTokenInvalid
+	}
+
+	return token.Claims, nil
+}
+
+//burnPurposeToken uses up the token with claims, it fails if someone else got there first
+func (c *appContext) burnPurposeToken(purpose string, claims map[string]interface{}) error {
+	jti, _ := claims["jti"].(string)
+	n, err := c.redis.Del("tokens:" + purpose + ":" + jti).Result()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return errPurposeTokenInvalid
+	}
+	return nil
+}
+
+//usePurposeToken validates a token made by signPurposeToken and burns it, so a
+//second call with the same token fails
+func (c *appContext) usePurposeToken(purpose, tokenString string) (map[string]interface{}, error) {
+	claims, err := c.parsePurposeToken(purpose, tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.burnPurposeToken(purpose, claims)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+//Handlers
+
+func (c *appContext) refreshHandler(w http.ResponseWriter, r *http.Request) {
+	body := context.Get(r, "body").(*TokenRequest)
+	if body.RefreshToken == "" {
+		WriteError(w, ErrInvalidRefreshToken)
+		return
+	}
+
+	refreshToken, record, err := c.rotateRefreshToken(body.RefreshToken)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInvalidRefreshToken)
+		return
+	}
+
+	repo := UserRepo{c.db.C("users")}
+	user, err := repo.Find(record.Username)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInvalidRefreshToken)
+		return
+	}
+
+	tokenString, err := c.signToken(&user.Data, record.Family)
+	if err != nil {
+		log.Printf("Token Signing error: %v\n", err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	c.writeTokens(w, &user.Data, "Token refreshed", tokenString, refreshToken)
+}
+
+func (c *appContext) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := userget(r)
+	if err != nil || user.Username == "" {
+		WriteError(w, ErrUnauthorized)
+		return
+	}
+
+	claims := claimsget(r)
+	if jti, ok := claims["jti"].(string); ok {
+		exp, _ := claims["exp"].(float64)
+		err = c.revokeToken(jti, int64(exp))
+		if err != nil {
+			log.Println(err)
+			WriteError(w, ErrInternalServer)
+			return
+		}
+	}
+
+	// the refresh token is optional, a client that lost it can still log
+	// out the access token it is holding
+	body := TokenRequest{}
+	err = json.NewDecoder(r.Body).Decode(&body)
+	if err != nil && err != io.EOF {
+		WriteError(w, ErrBadRequest)
+		return
+	}
+	if body.RefreshToken != "" {
+		err = c.revokeRefreshToken(body.RefreshToken, user.Username)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	// ending the session takes its refresh tokens with it, even when the
+	// client didn't send one
+	if sid, ok := claims["sid"].(string); ok && sid != "" {
+		err = c.revokeSession(user.Username, sid)
+		if err != nil && err != errSessionNotFound {
+			log.Println(err)
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:   c.token,
+		Value:  "",
+		Path:   "/",
+		MaxAge: -1,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
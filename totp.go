@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP as described in RFC 6238, with the parameters every authenticator app
+// understands: SHA1, 6 digits, 30 second steps.
+const (
+	totpPeriod = 30
+	totpDigits = 6
+
+	//totpSkew is how many steps either side of now are accepted, to forgive clock drift
+	totpSkew = 1
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+//newTOTPSecret returns a random base32 encoded secret
+func newTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+//totpURI is what authenticator apps expect in the QR code they scan
+func totpURI(secret, issuer, account string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+account) + "?" + v.Encode()
+}
+
+//totpCode returns the code for secret at time step
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000), nil
+}
+
+//validateTOTP checks code against secret at time t. It returns the time step the code
+//matched, so callers can refuse to see the same code twice
+func validateTOTP(secret, code string, t time.Time) (int64, bool) {
+	code = strings.Replace(code, " ", "", -1)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	now := t.Unix() / totpPeriod
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
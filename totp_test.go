@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// the SHA1 seed from RFC 6238, base32 encoded
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// the RFC 6238 SHA1 test vectors, cut down to 6 digits
+var rfc6238Vectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestTOTPCode(t *testing.T) {
+	for _, v := range rfc6238Vectors {
+		got, err := totpCode(rfc6238Secret, v.unix/totpPeriod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != v.code {
+			t.Errorf("totpCode at %d = %s, want %s", v.unix, got, v.code)
+		}
+	}
+
+	if got, _ := totpCode("gezdgnbvgy3tqojqgezdgnbvgy3tqojq", 1); got != "287082" {
+		t.Errorf("totpCode with a lower case secret = %s, want 287082", got)
+	}
+	if _, err := totpCode("not base32!", 1); err == nil {
+		t.Error("totpCode with a bad secret didn't fail")
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	at := time.Unix(1111111111, 0)
+	now := at.Unix() / totpPeriod
+	code := func(step int64) string {
+		c, _ := totpCode(rfc6238Secret, step)
+		return c
+	}
+
+	tests := []struct {
+		name string
+		code string
+		step int64
+		ok   bool
+	}{
+		{"now", "050471", now, true},
+		{"spaced", "050 471", now, true},
+		{"step before", code(now - 1), now - 1, true},
+		{"step after", code(now + 1), now + 1, true},
+		{"two steps before", code(now - 2), 0, false},
+		{"two steps after", code(now + 2), 0, false},
+		{"8 digits", "07081804", 0, false},
+		{"5 digits", "50471", 0, false},
+		{"empty", "", 0, false},
+		{"wrong", "123456", 0, false},
+	}
+	for _, tt := range tests {
+		step, ok := validateTOTP(rfc6238Secret, tt.code, at)
+		if ok != tt.ok || step != tt.step {
+			t.Errorf("%s: validateTOTP(%q) = %d, %v, want %d, %v", tt.name, tt.code, step, ok, tt.step, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/context"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/redis.v2"
+)
+
+const (
+	//TwoFactorChallengeTTL is how long a user has to enter their code after their password
+	TwoFactorChallengeTTL = time.Minute * 5
+
+	//TwoFactorChallengeAttempts is how many wrong codes a challenge survives
+	TwoFactorChallengeAttempts = 5
+
+	//TwoFactorEnrollTTL is how long an enrollment waits to be confirmed
+	TwoFactorEnrollTTL = time.Minute * 10
+
+	//RecoveryCodeCount is how many recovery codes a user gets when turning on 2FA
+	RecoveryCodeCount = 10
+
+	twoFactorPurpose = "2fa_challenge"
+	totpIssuer       = "oddjobz"
+)
+
+var errSecondFactor = errors.New("invalid two factor code")
+
+//TwoFactorRequest is the body of the 2FA endpoints
+type TwoFactorRequest struct {
+	Code           string `json:"code"`
+	ChallengeToken string `json:"challenge_token,omitempty"`
+}
+
+//TwoFactorChallenge is sent back instead of a token when the password was right but
+//the account still needs a code
+type TwoFactorChallenge struct {
+	Message        string `json:"message"`
+	ChallengeToken string `json:"challenge_token"`
+}
+
+//TwoFactorEnrollment carries what an authenticator app needs to start producing codes
+type TwoFactorEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+//RecoveryCodes are shown to the user once, when 2FA is turned on
+type RecoveryCodes struct {
+	Codes []string `json:"recovery_codes"`
+}
+
+//Utility methods
+
+// the same code is good for up to three steps because of the skew, this
+// makes sure it only works once
+var totpStepRedisScript = redis.NewScript(`
+	local last = tonumber(redis.call("get", KEYS[1]) or "0")
+	if tonumber(ARGV[1]) <= last then
+		return 0
+	end
+	redis.call("set", KEYS[1], ARGV[1], "EX", ARGV[2])
+	return 1
+`)
+
+//useTOTPStep records that username used the code for step, it returns false if that
+//code (or a later one) was already used
+func (c *appContext) useTOTPStep(username string, step int64) (bool, error) {
+	ttl := strconv.Itoa(totpPeriod * (2*totpSkew + 1))
+	resp, err := totpStepRedisScript.Run(c.redis, []string{"users:" + username + ":totp-last"}, []string{strconv.FormatInt(step, 10), ttl}).Result()
+	if err != nil {
+		return false, err
+	}
+	return resp.(int64) == 1, nil
+}
+
+//checkSecondFactor accepts either a current code from the user's authenticator app or
+//one of their recovery codes, which is then crossed off
+func (c *appContext) checkSecondFactor(user *User, code string) error {
+	if step, ok := validateTOTP(user.TOTPSecret, code, time.Now()); ok {
+		fresh, err := c.useTOTPStep(user.Username, step)
+		if err != nil {
+			return err
+		}
+		if !fresh {
+			return errSecondFactor
+		}
+		return nil
+	}
+
+	hash := hashToken(code)
+	for _, h := range user.RecoveryCodes {
+		if h != hash {
+			continue
+		}
+		// matching on the code as well means two requests racing
+		// with the same code can't both win
+		return c.db.C("users").Update(bson.M{
+			"username":      user.Username,
+			"recoverycodes": hash,
+		}, bson.M{
+			"$pull": bson.M{"recoverycodes": hash},
+		})
+	}
+
+	return errSecondFactor
+}
+
+//newRecoveryCodes returns a fresh set of recovery codes, and the hashes of them to store
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, RecoveryCodeCount)
+	hashes := make([]string, RecoveryCodeCount)
+	for i := range codes {
+		code, err := randToken(5)
+		if err != nil {
+			return nil, nil, err
+		}
+		codes[i] = code
+		hashes[i] = hashToken(code)
+	}
+	return codes, hashes, nil
+}
+
+//writeTwoFactorChallenge answers a sign in that got the password right with a short lived
+//challenge token, to be traded for a real token along with a code
+func (c *appContext) writeTwoFactorChallenge(w http.ResponseWriter, user *User) {
+	token, err := c.signPurposeToken(twoFactorPurpose, map[string]interface{}{
+		"username": user.Username,
+	}, TwoFactorChallengeTTL)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(TwoFactorChallenge{
+		Message:        "Two factor authentication required",
+		ChallengeToken: token,
+	})
+}
+
+//currentUser loads the full record of the user the request was authenticated as
+func (c *appContext) currentUser(r *http.Request) (*User, error) {
+	user, err := userget(r)
+	if err != nil {
+		return nil, err
+	}
+	if user.Username == "" {
+		return nil, mgo.ErrNotFound
+	}
+
+	repo := UserRepo{c.db.C("users")}
+	userD, err := repo.Find(user.Username)
+	if err != nil {
+		return nil, err
+	}
+	return &userD.Data, nil
+}
+
+//Handlers
+
+func (c *appContext) twoFactorLoginHandler(w http.ResponseWriter, r *http.Request) {
+	body := context.Get(r, "body").(*TwoFactorRequest)
+	claims, err := c.parsePurposeToken(twoFactorPurpose, body.ChallengeToken)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInvalidChallenge)
+		return
+	}
+
+	jti, _ := claims["jti"].(string)
+	attempts, err := c.increx("tokens:"+twoFactorPurpose+":"+jti+":attempts", TwoFactorChallengeTTL)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+	if attempts > TwoFactorChallengeAttempts {
+		c.burnPurposeToken(twoFactorPurpose, claims)
+		WriteError(w, ErrInvalidChallenge)
+		return
+	}
+
+	username, _ := claims["username"].(string)
+	repo := UserRepo{c.db.C("users")}
+	user, err := repo.Find(username)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInvalidChallenge)
+		return
+	}
+
+	// wrong codes count against the account like wrong passwords do, across
+	// challenges, so signing in again doesn't buy more guesses
+	account := user.Data.Email
+	if account == "" {
+		account = user.Data.Username
+	}
+	ip := clientIP(r)
+	wait, locked, err := c.loginThrottled(account, ip)
+	if err != nil {
+		log.Println(err)
+	}
+	if locked {
+		w.Header().Set("Retry-After", seconds(wait))
+		WriteError(w, ErrAccountLocked)
+		return
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", seconds(wait))
+		WriteError(w, ErrTooManyAttempts)
+		return
+	}
+
+	err = c.checkSecondFactor(&user.Data, body.Code)
+	if err != nil {
+		log.Println(err)
+		c.loginFailed(account, ip, &user.Data)
+		WriteError(w, ErrInvalidSecondFactor)
+		return
+	}
+
+	err = c.burnPurposeToken(twoFactorPurpose, claims)
+	if err != nil {
+		WriteError(w, ErrInvalidChallenge)
+		return
+	}
+
+	c.loginSucceeded(account)
+	c.writeTokenResponse(w, r, &user.Data, "Signed in")
+}
+
+func (c *appContext) enrollTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := c.currentUser(r)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrUnauthorized)
+		return
+	}
+	if user.TOTPEnabled {
+		WriteError(w, ErrTwoFactorEnabled)
+		return
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	// nothing changes on the account until the user proves their app
+	// has the secret
+	err = c.setex("users:"+user.Username+":totp-pending", secret, TwoFactorEnrollTTL)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	account := user.Email
+	if account == "" {
+		account = user.Username
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(TwoFactorEnrollment{
+		Secret: secret,
+		URI:    totpURI(secret, totpIssuer, account),
+	})
+}
+
+func (c *appContext) confirmTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	body := context.Get(r, "body").(*TwoFactorRequest)
+	user, err := c.currentUser(r)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrUnauthorized)
+		return
+	}
+
+	key := "users:" + user.Username + ":totp-pending"
+	secret, err := c.redis.Get(key).Result()
+	if err == redis.Nil {
+		WriteError(w, ErrNotFound)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	step, ok := validateTOTP(secret, body.Code, time.Now())
+	if !ok {
+		WriteError(w, ErrInvalidSecondFactor)
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	err = c.db.C("users").Update(bson.M{
+		"username": user.Username,
+	}, bson.M{
+		"$set": bson.M{
+			"totpenabled":   true,
+			"totpsecret":    secret,
+			"recoverycodes": hashes,
+		},
+	})
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	c.redis.Del(key)
+	c.useTOTPStep(user.Username, step)
+
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(RecoveryCodes{codes})
+}
+
+func (c *appContext) disableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	body := context.Get(r, "body").(*TwoFactorRequest)
+	user, err := c.currentUser(r)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrUnauthorized)
+		return
+	}
+	if !user.TOTPEnabled {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	err = c.checkSecondFactor(user, body.Code)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInvalidSecondFactor)
+		return
+	}
+
+	err = c.db.C("users").Update(bson.M{
+		"username": user.Username,
+	}, bson.M{
+		"$set":   bson.M{"totpenabled": false},
+		"$unset": bson.M{"totpsecret": "", "recoverycodes": ""},
+	})
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,15 +1,19 @@
 package main
 
-//Images makes dealing with thumbnails and full size images easier
+//Images makes dealing with thumbnails and full size images easier. Uploaded images
+//also know where their copies are stored, so they can be deleted with them
 type Images struct {
-	Thumb string `json:"thumb"`
-	Full  string `json:"full"`
+	ID       string `json:"id,omitempty" bson:"id,omitempty"`
+	Thumb    string `json:"thumb"`
+	Full     string `json:"full"`
+	ThumbKey string `json:"-" bson:"thumbkey,omitempty"`
+	FullKey  string `json:"-" bson:"fullkey,omitempty"`
 }
 
 //lookUp holds reference data liking a providers collection eith the users
 //collection
 type lookUp struct {
-	Provider    string
-	ProviderUID string
-	UserID      string
+	Provider    string `json:"provider" bson:"provider"`
+	ProviderUID string `json:"provider_uid" bson:"provideruid"`
+	UserID      string `json:"-" bson:"userid"`
 }
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	//OnboardingTTL is how long a new user has to pick a username after signing in
+	OnboardingTTL = time.Hour
+
+	onboardingPurpose = "onboarding"
+)
+
+var (
+	errUsernameInvalid  = errors.New("username invalid")
+	errUsernameReserved = errors.New("username reserved")
+	errUsernameTaken    = errors.New("username taken")
+
+	// 3 to 30 characters, starting and ending with a letter or digit
+	usernamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{1,28}[a-z0-9]$`)
+)
+
+// names that would clash with routes, or that someone could use to pass
+// themselves off as us
+var reservedUsernames = map[string]bool{
+	"admin": true, "administrator": true, "api": true, "auth": true, "deleted": true,
+	"help": true, "me": true, "moderator": true, "oddjobz": true, "root": true,
+	"settings": true, "signup": true, "skills": true, "staff": true, "support": true,
+	"system": true, "user": true, "users": true, "usernames": true, "www": true,
+}
+
+//UsernameRequest is the body for claiming a username
+type UsernameRequest struct {
+	Username        string `json:"username"`
+	OnboardingToken string `json:"onboarding_token"`
+}
+
+//UsernameAvailability says whether a username can be claimed, and why not
+type UsernameAvailability struct {
+	Username  string `json:"username"`
+	Available bool   `json:"available"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+//Utility methods
+
+//validUsername checks name against the naming rules and the reserved names
+func validUsername(name string) error {
+	if !usernamePattern.MatchString(name) || strings.Contains(name, "..") {
+		return errUsernameInvalid
+	}
+	if reservedUsernames[name] {
+		return errUsernameReserved
+	}
+	return nil
+}
+
+//usernameAvailable reports whether name could be claimed right now
+func (c *appContext) usernameAvailable(name string) (bool, error) {
+	err := validUsername(name)
+	if err != nil {
+		return false, err
+	}
+	taken, err := c.redis.SIsMember("users", name).Result()
+	if err != nil {
+		return false, err
+	}
+	if taken {
+		return false, errUsernameTaken
+	}
+	return true, nil
+}
+
+//claimUsername gives name to the user with mongo id id, if they don't have one yet. The
+//"users" set is what makes it atomic, whoever adds the name to it first gets it
+func (c *appContext) claimUsername(id, name string) (*User, error) {
+	err := validUsername(name)
+	if err != nil {
+		return nil, err
+	}
+
+	added, err := c.redis.SAdd("users", name).Result()
+	if err != nil {
+		return nil, err
+	}
+	if added == 0 {
+		return nil, errUsernameTaken
+	}
+
+	result := User{}
+	_, err = c.db.C("users").Find(bson.M{
+		"_id": bson.ObjectIdHex(id),
+		"$or": []bson.M{
+			{"username": bson.M{"$exists": false}},
+			{"username": ""},
+		},
+	}).Apply(mgo.Change{
+		Update:    bson.M{"$set": bson.M{"username": name}},
+		ReturnNew: true,
+	}, &result)
+	if mgo.IsDup(err) {
+		// the set was missing a name mongo already has, keep it in the set
+		return nil, errUsernameTaken
+	}
+	if err != nil {
+		// the name is no use to someone who already has one
+		c.redis.SRem("users", name)
+		return nil, err
+	}
+	return &result, nil
+}
+
+//syncUsernames adds every username in mongo to the "users" set, so names taken before
+//the set was the source of truth can't be claimed again
+func (c *appContext) syncUsernames() error {
+	var names []string
+	err := c.db.C("users").Find(bson.M{"username": bson.M{"$nin": []interface{}{"", nil}}}).Distinct("username", &names)
+	if err != nil {
+		return err
+	}
+	for len(names) > 0 {
+		n := len(names)
+		if n > 1000 {
+			n = 1000
+		}
+		err = c.redis.SAdd("users", names[:n]...).Err()
+		if err != nil {
+			return err
+		}
+		names = names[n:]
+	}
+	return nil
+}
+
+//claimSuggestedUsername tries to give a new user with mongo id id the username their
+//client sent along with the sign up. A name they can't have is not an error, user comes
+//back without one and they pick another while onboarding
+func (c *appContext) claimSuggestedUsername(id, name string, user *User) *User {
+	if name == "" || user.Username != "" {
+		return user
+	}
+	claimed, err := c.claimUsername(id, strings.ToLower(strings.TrimSpace(name)))
+	if err != nil {
+		log.Println(err)
+		return user
+	}
+	return claimed
+}
+
+//signOnboardingToken lets a user that signed in without a username come back and pick one
+func (c *appContext) signOnboardingToken(user *User) (string, error) {
+	repo := UserRepo{c.db.C("users")}
+	id, err := repo.userID(bson.M{"pid": user.PID, "provider": user.Provider})
+	if err != nil {
+		return "", err
+	}
+	return c.signPurposeToken(onboardingPurpose, map[string]interface{}{
+		"userid": id,
+	}, OnboardingTTL)
+}
+
+//Handlers
+
+func (c *appContext) usernameAvailableHandler(w http.ResponseWriter, r *http.Request) {
+	params := context.Get(r, "params").(httprouter.Params)
+	name := strings.ToLower(params.ByName("name"))
+
+	result := UsernameAvailability{Username: name}
+	available, err := c.usernameAvailable(name)
+	switch err {
+	case nil:
+		result.Available = available
+	case errUsernameInvalid:
+		result.Reason = "invalid"
+	case errUsernameReserved:
+		result.Reason = "reserved"
+	case errUsernameTaken:
+		result.Reason = "taken"
+	default:
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func (c *appContext) claimUsernameHandler(w http.ResponseWriter, r *http.Request) {
+	body := context.Get(r, "body").(*UsernameRequest)
+	claims, err := c.parsePurposeToken(onboardingPurpose, body.OnboardingToken)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrUnauthorized)
+		return
+	}
+	id, _ := claims["userid"].(string)
+	if !bson.IsObjectIdHex(id) {
+		WriteError(w, ErrUnauthorized)
+		return
+	}
+
+	user, err := c.claimUsername(id, strings.ToLower(strings.TrimSpace(body.Username)))
+	switch err {
+	case nil:
+	case errUsernameInvalid:
+		WriteError(w, ErrInvalidUsername)
+		return
+	case errUsernameReserved, errUsernameTaken:
+		WriteError(w, ErrUsernameTaken)
+		return
+	case mgo.ErrNotFound:
+		WriteError(w, ErrUsernameAlreadySet)
+		return
+	default:
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	err = c.burnPurposeToken(onboardingPurpose, claims)
+	if err != nil {
+		log.Println(err)
+	}
+
+	c.writeSignIn(w, r, user, "Sign up complete")
+}
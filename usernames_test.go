@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestValidUsername(t *testing.T) {
+	tests := []struct {
+		name string
+		want error
+	}{
+		{"ada", nil},
+		{"ada.lovelace", nil},
+		{"ada_l-1", nil},
+		{"a1b", nil},
+		{"ab", errUsernameInvalid},
+		{"Ada", errUsernameInvalid},
+		{".ada", errUsernameInvalid},
+		{"ada-", errUsernameInvalid},
+		{"ada..l", errUsernameInvalid},
+		{"ada l", errUsernameInvalid},
+		{"adé", errUsernameInvalid},
+		{"abcdefghijklmnopqrstuvwxyz1234", nil},
+		{"abcdefghijklmnopqrstuvwxyz12345", errUsernameInvalid},
+		{"", errUsernameInvalid},
+		{"admin", errUsernameReserved},
+		{"me", errUsernameInvalid},
+		{"support", errUsernameReserved},
+	}
+	for _, tt := range tests {
+		if got := validUsername(tt.name); got != tt.want {
+			t.Errorf("validUsername(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -4,28 +4,46 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/context"
 	"github.com/julienschmidt/httprouter"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
-	"gopkg.in/redis.v2"
 )
 
 //User carries user data for exchange, especially in views
 type User struct {
-	ID         string `json:"id,ommitempty" bson:",omitempty"`
-	PID        string `json:"pid,omitempty" bson:",omitempty"`
-	Provider   string `json:"provider,omitempty"`
-	Username   string `json:"username,omitempty"`
-	Password   string `json:",ommitempty"`
-	Permission string `json:"permission,omitempty" bson:"permission,omitempty"`
-	Image      string `json:"image,omitempty"`
-	Name       string `json:"name,omitempty"`
-	Link       string `json:"link,omitempty"`
-	Gender     string `json:"gender,omitempty"`
-	Email      string `json:"email,omitempty"`
-	Phone      string `json:"phone,omitempty"`
+	ID            string `json:"id,omitempty" bson:",omitempty"`
+	PID           string `json:"pid,omitempty" bson:",omitempty"`
+	Provider      string `json:"provider,omitempty"`
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"-"`
+	Permission    string `json:"permission,omitempty" bson:"permission,omitempty"`
+	Image         string `json:"image,omitempty"`
+	Name          string `json:"name,omitempty"`
+	Link          string `json:"link,omitempty"`
+	Gender        string `json:"gender,omitempty"`
+	Email         string `json:"email,omitempty"`
+	Phone         string `json:"phone,omitempty"`
+	PhoneVerified bool   `json:"phone_verified" bson:"phoneverified"`
+	Bio           string `json:"bio,omitempty"`
+	City          string `json:"city,omitempty"`
+	Verified      bool   `json:"verified" bson:"verified"`
+	IDToken       string `json:"id_token,omitempty" bson:"-"`
+
+	FollowersCount int64 `json:"followers_count" bson:"-"`
+	FollowingCount int64 `json:"following_count" bson:"-"`
+	IsFollowing    bool  `json:"is_following" bson:"-"`
+
+	TOTPEnabled   bool     `json:"totp_enabled" bson:"totpenabled"`
+	TOTPSecret    string   `json:"-" bson:"totpsecret,omitempty"`
+	RecoveryCodes []string `json:"-" bson:"recoverycodes,omitempty"`
+
+	Avatar *Images `json:"-" bson:"avatar,omitempty"`
+
+	DeletedAt time.Time `json:"-" bson:"deletedat,omitempty"`
+	PurgeAt   time.Time `json:"-" bson:"purgeat,omitempty"`
 }
 
 //UsersCollection holds a slice of user structs under the key "data", which culd be marshalled and sent to a client under json schema standard
@@ -55,12 +73,14 @@ func (r *UserRepo) All() (UsersCollection, error) {
 	return result, nil
 }
 
-//Find would return a user struct based on the username of the user, which is the query
+//Find would return a user struct based on the username of the user, which is the query. Deleted
+//accounts waiting to be purged are not found
 func (r *UserRepo) Find(query string) (UserResource, error) {
 	result := UserResource{}
 
 	err := r.coll.Find(bson.M{
-		"username": query,
+		"username":  query,
+		"deletedat": bson.M{"$exists": false},
 	}).One(&result.Data)
 	if err != nil {
 		return result, err
@@ -69,46 +89,66 @@ func (r *UserRepo) Find(query string) (UserResource, error) {
 }
 
 //Authenticate check if user exists if not create a new user document NewUser function is called within this function. note the user struct being passed
-//to this function should alredi contain a self generated objectid
+//to this function should carry the id token the provider issued, the pid is taken from it
 func (c *appContext) Authenticate(user *User, provider string) (*User, error) {
 	log.Println("Authenticate")
 	result := User{}
 	C := c.db.C("users")
 
+	verifier, ok := c.verifiers[provider]
+	if !ok {
+		return &result, errUnknownProvider
+	}
+	identity, err := verifier.Verify(user.IDToken)
+	if err != nil {
+		return &result, err
+	}
+
+	// whatever the client says, the provider has the last word on who this is
+	user.PID = identity.PID
+	if identity.Email != "" {
+		user.Email = identity.Email
+	}
+	if user.Name == "" {
+		user.Name = identity.Name
+	}
+	if user.Image == "" {
+		user.Image = identity.Image
+	}
+
 	log.Println(user.PID)
 	log.Println(provider)
 
-	var change mgo.Change
-	if user.Username != "" {
-		err := c.redis.SAdd("users", user.Username).Err()
-		if err != nil {
-			log.Println(err)
-		}
-		change = mgo.Change{
-			Update: bson.M{"$set": bson.M{
-				"pid":      user.PID,
-				"name":     user.Name,
-				"email":    user.Email,
-				"image":    user.Image,
-				"username": user.Username,
-				"phone":    user.Phone,
-			},
-			},
-			Upsert:    true,
-			ReturnNew: true,
-		}
-	} else {
-		change = mgo.Change{
-			Update: bson.M{"$set": bson.M{
-				"pid":   user.PID,
-				"name":  user.Name,
-				"email": user.Email,
-				"image": user.Image,
-			},
-			},
-			Upsert:    true,
-			ReturnNew: true,
-		}
+	// a login we have seen before, or a verified email we already know,
+	// signs in to the account it belongs to
+	linked, err := c.linkedUser(identity)
+	if err == nil {
+		return linked, nil
+	}
+	if err != mgo.ErrNotFound {
+		return &result, err
+	}
+	linked, err = c.linkByEmail(identity)
+	if err == nil {
+		return linked, nil
+	}
+	if err != mgo.ErrNotFound {
+		return &result, err
+	}
+
+	// the username the client asked for goes through the same claim as
+	// onboarding, once the user exists
+	change := mgo.Change{
+		Update: bson.M{"$set": bson.M{
+			"pid":      user.PID,
+			"name":     user.Name,
+			"email":    user.Email,
+			"image":    user.Image,
+			"verified": identity.EmailVerified,
+		},
+		},
+		Upsert:    true,
+		ReturnNew: true,
 	}
 	info, err := C.Find(bson.M{"pid": user.PID, "provider": provider}).Apply(change, &result)
 	log.Println(info)
@@ -117,6 +157,17 @@ func (c *appContext) Authenticate(user *User, provider string) (*User, error) {
 	if err != nil {
 		return &result, err
 	}
+	c.ensureIdentity(bson.M{"pid": user.PID, "provider": provider}, provider, user.PID)
+
+	if user.Username != "" && result.Username == "" {
+		repo := UserRepo{C}
+		id, err := repo.userID(bson.M{"pid": user.PID, "provider": provider})
+		if err != nil {
+			log.Println(err)
+			return &result, nil
+		}
+		return c.claimSuggestedUsername(id, user.Username, &result), nil
+	}
 	//if result.Provider != "" {
 	//	return &result, nil
 	//}
@@ -142,8 +193,9 @@ func (c *appContext) NewUser(data *User) (*User, error) {
 
 func (c *appContext) meHandler(w http.ResponseWriter, r *http.Request) {
 	user, err := userget(r)
-	if err != nil {
-		log.Println(err)
+	if err != nil || user.Username == "" {
+		WriteError(w, ErrUnauthorized)
+		return
 	}
 
 	//log.Println(user)
@@ -151,10 +203,14 @@ func (c *appContext) meHandler(w http.ResponseWriter, r *http.Request) {
 	userD, err := repo.Find(user.Username)
 	if err != nil {
 		log.Println(err)
+		WriteError(w, ErrNotFound)
+		return
 	}
+	users := []User{userD.Data}
+	c.checkFollowedState(users, "")
 
 	w.Header().Set("Content-Type", "application/vdn.api+json")
-	json.NewEncoder(w).Encode(userD)
+	json.NewEncoder(w).Encode(UserView{selfUser(&users[0])})
 
 }
 
@@ -166,49 +222,12 @@ func (c *appContext) userHandler(w http.ResponseWriter, r *http.Request) {
 	user, err := repo.Find(username)
 	if err != nil {
 		log.Println(err)
+		WriteError(w, ErrNotFound)
+		return
 	}
+	viewer, _ := userget(r)
+	users := []User{user.Data}
+	c.checkFollowedState(users, viewer.Username)
 
-	w.Header().Set("Content-Type", "application/vnd.api+json")
-	json.NewEncoder(w).Encode(user)
-}
-
-func (c *appContext) toggleUserFollowHandler(w http.ResponseWriter, r *http.Request) {
-	params := context.Get(r, "params").(httprouter.Params)
-	followUsername := params.ByName("username")
-	user, err := userget(r)
-	if err != nil {
-		log.Println(err)
-	}
-
-	followToggle := redis.NewScript(`
-
-	 	followers =  "users:"..KEYS[1]..":followers"
-		following =  "users:"..KEYS[1]..":following"
-		local ids = redis.call("sismember", followers)
-		-- print(unpack(ids))
-		if ids == 1 do
-			redis.call("srem", followers, ARGV[1])
-			redis.call("srem", following, ARGV[1])
-		else
-			redis.call("sadd", followers, ARGV[1])
-			redis.call("sadd", following, ARGV[1])
-		end
-
-		return x
-	`)
-
-	resp, err := followToggle.Run(c.redis, []string{user.Username}, []string{followUsername}).Result()
-	if err != nil {
-		log.Println(resp, err)
-	}
-
-}
-
-func (c *appContext) checkFollowedState(users *[]User, username string) {
-	followers, err := c.redis.SMembers("users:" + username + ":followers").Result()
-	if err != nil {
-		log.Println(err)
-	}
-
-	log.Println(followers)
+	writeUser(w, r, &users[0])
 }
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// A User is never written out as it is. Whoever is asking gets one of these
+// views instead, and each of them lists its fields explicitly, so a field
+// added to User stays private until someone decides which views show it.
+
+//PublicUser is what anyone can see of a user
+type PublicUser struct {
+	Username       string `json:"username"`
+	Name           string `json:"name,omitempty"`
+	Image          string `json:"image,omitempty"`
+	Thumb          string `json:"thumb,omitempty"`
+	Bio            string `json:"bio,omitempty"`
+	City           string `json:"city,omitempty"`
+	Link           string `json:"link,omitempty"`
+	Role           string `json:"role"`
+	FollowersCount int64  `json:"followers_count"`
+	FollowingCount int64  `json:"following_count"`
+	IsFollowing    bool   `json:"is_following"`
+}
+
+//SelfUser is what a user sees of themselves
+type SelfUser struct {
+	PublicUser
+	Provider      string `json:"provider,omitempty"`
+	Email         string `json:"email,omitempty"`
+	Verified      bool   `json:"verified"`
+	Phone         string `json:"phone,omitempty"`
+	PhoneVerified bool   `json:"phone_verified"`
+	Gender        string `json:"gender,omitempty"`
+	TOTPEnabled   bool   `json:"totp_enabled"`
+}
+
+//AdminUser is what admins see of a user
+type AdminUser struct {
+	SelfUser
+	PID       string     `json:"pid,omitempty"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	PurgeAt   *time.Time `json:"purge_at,omitempty"`
+}
+
+//UserView carries a single user, in whichever view, under the key "data"
+type UserView struct {
+	Data interface{} `json:"data"`
+}
+
+//publicUser is the public view of u
+func publicUser(u *User) PublicUser {
+	thumb := ""
+	if u.Avatar != nil {
+		thumb = u.Avatar.Thumb
+	}
+	return PublicUser{
+		Username:       u.Username,
+		Name:           u.Name,
+		Image:          u.Image,
+		Thumb:          thumb,
+		Bio:            u.Bio,
+		City:           u.City,
+		Link:           u.Link,
+		Role:           userRole(u.Permission),
+		FollowersCount: u.FollowersCount,
+		FollowingCount: u.FollowingCount,
+		IsFollowing:    u.IsFollowing,
+	}
+}
+
+//publicUsers is the public view of every user in users
+func publicUsers(users []User) []PublicUser {
+	views := []PublicUser{}
+	for i := range users {
+		views = append(views, publicUser(&users[i]))
+	}
+	return views
+}
+
+//selfUser is the view u gets of themselves
+func selfUser(u *User) SelfUser {
+	return SelfUser{
+		PublicUser:    publicUser(u),
+		Provider:      u.Provider,
+		Email:         u.Email,
+		Verified:      u.Verified,
+		Phone:         u.Phone,
+		PhoneVerified: u.PhoneVerified,
+		Gender:        u.Gender,
+		TOTPEnabled:   u.TOTPEnabled,
+	}
+}
+
+//adminUser is the view admins get of u
+func adminUser(u *User) AdminUser {
+	view := AdminUser{
+		SelfUser: selfUser(u),
+		PID:      u.PID,
+	}
+	// only accounts that were deleted have these
+	if !u.DeletedAt.IsZero() {
+		deletedAt, purgeAt := u.DeletedAt, u.PurgeAt
+		view.DeletedAt, view.PurgeAt = &deletedAt, &purgeAt
+	}
+	return view
+}
+
+//userView picks the view of u the request gets to see: their own, an admin's or the public one
+func userView(r *http.Request, u *User) interface{} {
+	viewer, _ := userget(r)
+	if role, ok := roleget(r); ok && hasPermission(role, PermUsersAdmin) && apiKeyAllows(r, PermUsersAdmin) {
+		return adminUser(u)
+	}
+	if viewer.Username != "" && viewer.Username == u.Username {
+		return selfUser(u)
+	}
+	return publicUser(u)
+}
+
+//writeUser sends u back in the view the request gets to see
+func writeUser(w http.ResponseWriter, r *http.Request, u *User) {
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	json.NewEncoder(w).Encode(UserView{userView(r, u)})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUserViewsHideSecrets(t *testing.T) {
+	u := &User{
+		Username:      "jdoe",
+		Name:          "John Doe",
+		Email:         "jdoe@example.com",
+		Password:      "$2a$10$Qm9ndXNIYXNoT2ZBUGFzc3dvcmQ",
+		TOTPEnabled:   true,
+		TOTPSecret:    "JBSWY3DPEHPK3PXP",
+		RecoveryCodes: []string{"k3j9-x8q2", "p0w7-m4n1"},
+		DeletedAt:     time.Now(),
+		PurgeAt:       time.Now().Add(AccountDeletionGrace),
+	}
+	secrets := append([]string{u.Password, u.TOTPSecret}, u.RecoveryCodes...)
+
+	views := []struct {
+		name string
+		view interface{}
+	}{
+		{"public", publicUser(u)},
+		{"self", selfUser(u)},
+		{"admin", adminUser(u)},
+	}
+	for _, v := range views {
+		b, err := json.Marshal(v.view)
+		if err != nil {
+			t.Fatalf("%s: %v", v.name, err)
+		}
+		if !strings.Contains(string(b), `"username":"jdoe"`) {
+			t.Errorf("%s view is missing the username: %s", v.name, b)
+		}
+		for _, secret := range secrets {
+			if strings.Contains(string(b), secret) {
+				t.Errorf("%s view leaks %q: %s", v.name, secret, b)
+			}
+		}
+	}
+}
+
+func TestAdminUserDeletion(t *testing.T) {
+	tests := []struct {
+		name    string
+		user    User
+		deleted bool
+	}{
+		{"active", User{Username: "jdoe"}, false},
+		{"deleted", User{Username: "jdoe", DeletedAt: time.Now(), PurgeAt: time.Now().Add(AccountDeletionGrace)}, true},
+	}
+	for _, tt := range tests {
+		b, err := json.Marshal(adminUser(&tt.user))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		for _, field := range []string{`"deleted_at"`, `"purge_at"`} {
+			if strings.Contains(string(b), field) != tt.deleted {
+				t.Errorf("%s: %s shown is %v, want %v: %s", tt.name, field, !tt.deleted, tt.deleted, b)
+			}
+		}
+	}
+}
@@ -1,24 +1,50 @@
 package main
 
 import (
-	"math/rand"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	mrand "math/rand"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/context"
 	"github.com/mitchellh/mapstructure"
+	"gopkg.in/redis.v2"
 )
 
 func randSeq(n int) string {
 	letters := []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
 	b := make([]rune, n)
 	for i := range b {
-		b[i] = letters[rand.Intn(len(letters))]
+		b[i] = letters[mrand.Intn(len(letters))]
 
 	}
 	return string(b)
 
 }
 
+//randToken returns n cryptographically random bytes, hex encoded. It is what
+//we hand out whenever a secret value has to be guessed by nobody.
+func randToken(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+//hashToken is used to store secrets we hand out (refresh tokens and the likes)
+//so a dump of redis doesn't hand them to whoever has it
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 func userget(r *http.Request) (User, error) {
 	u := context.Get(r, "User")
 	var user User
@@ -29,3 +55,54 @@ func userget(r *http.Request) (User, error) {
 	return user, nil
 
 }
+
+var setexRedisScript = redis.NewScript(`
+	redis.call("set", KEYS[1], ARGV[1], "EX", ARGV[2])
+	return 1
+`)
+
+//setex stores value under key and lets redis expire it after ttl
+func (c *appContext) setex(key, value string, ttl time.Duration) error {
+	seconds := int64(ttl / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return setexRedisScript.Run(c.redis, []string{key}, []string{value, strconv.FormatInt(seconds, 10)}).Err()
+}
+
+//clientIP returns the address the request came from. Behind the heroku router the
+//last entry of X-Forwarded-For is the one the router saw, anything before it is
+//whatever the client chose to send
+func clientIP(r *http.Request) string {
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		parts := strings.Split(xff, ",")
+		return strings.TrimSpace(parts[len(parts)-1])
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+var increxRedisScript = redis.NewScript(`
+	local n = redis.call("incr", KEYS[1])
+	if n == 1 then
+		redis.call("expire", KEYS[1], ARGV[1])
+	end
+	return n
+`)
+
+//increx increments the counter at key, which redis forgets ttl after its first increment
+func (c *appContext) increx(key string, ttl time.Duration) (int64, error) {
+	seconds := int64(ttl / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	resp, err := increxRedisScript.Run(c.redis, []string{key}, []string{strconv.FormatInt(seconds, 10)}).Result()
+	if err != nil {
+		return 0, err
+	}
+	return resp.(int64), nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	//EmailVerificationTTL is how long the link sent to a new local user stays valid
+	EmailVerificationTTL = time.Hour * 48
+
+	verifyEmailPurpose = "verify_email"
+)
+
+//VerificationRequest carries the token from the verification email when it is POSTed back
+type VerificationRequest struct {
+	Token string `json:"token"`
+}
+
+//Utility methods
+
+//sendVerificationEmail mails user a single use link to verify their email address
+func (c *appContext) sendVerificationEmail(user *User) error {
+	token, err := c.signPurposeToken(verifyEmailPurpose, map[string]interface{}{
+		"email": user.Email,
+	}, EmailVerificationTTL)
+	if err != nil {
+		return err
+	}
+
+	link := c.domain + "/api/v0.1/auth/verify?token=" + url.QueryEscape(token)
+	body := "Hi " + user.Name + ",\n\n" +
+		"Please confirm your email address for oddjobz by opening the link below:\n\n" +
+		link + "\n\n" +
+		"The link expires in 48 hours. If you did not sign up, you can ignore this email."
+
+	return c.mailer.Send(user.Email, "Verify your oddjobz email address", body)
+}
+
+//verifyEmail burns a verification token and marks the local account it was issued for as verified
+func (c *appContext) verifyEmail(token string) error {
+	claims, err := c.usePurposeToken(verifyEmailPurpose, token)
+	if err != nil {
+		return err
+	}
+
+	email, _ := claims["email"].(string)
+	return c.db.C("users").Update(bson.M{
+		"provider": "local",
+		"email":    email,
+	}, bson.M{
+		"$set": bson.M{"verified": true},
+	})
+}
+
+//isVerified reports whether user can do things reserved for verified accounts. Only local
+//accounts need to verify, providers have already checked the email for us
+func (user *User) isVerified() bool {
+	return user.Provider != "local" || user.Verified
+}
+
+//Handlers
+
+func (c *appContext) verifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if r.Method == "POST" {
+		body := VerificationRequest{}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil && err != io.EOF {
+			WriteError(w, ErrBadRequest)
+			return
+		}
+		if body.Token != "" {
+			token = body.Token
+		}
+	}
+
+	err := c.verifyEmail(token)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInvalidVerificationToken)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(struct {
+		Message string `json:"message"`
+	}{"Email verified"})
+}
+
+func (c *appContext) resendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := userget(r)
+	if err != nil || user.Username == "" {
+		WriteError(w, ErrUnauthorized)
+		return
+	}
+
+	repo := UserRepo{c.db.C("users")}
+	userD, err := repo.Find(user.Username)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrUnauthorized)
+		return
+	}
+
+	if userD.Data.isVerified() {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	err = c.sendVerificationEmail(&userD.Data)
+	if err != nil {
+		log.Println(err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}